@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	f, err := ioutil.TempFile("", "javertd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(s)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	p := writeConfig(t, `
+hostname: proxy.example.com
+auth:
+  username: user
+  password: pass
+policy:
+  rules:
+    - deny port=22
+    - allow
+deniedNets: [default, 192.0.2.0/24]
+timeouts:
+  idle: 1m
+listeners:
+  - addr: "[::1]:3128"
+    authSchemes: [Digest]
+`)
+	defer os.Remove(p)
+	c, err := loadConfig(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listeners) != 1 || c.Listeners[0].Addr != "[::1]:3128" || c.Listeners[0].line != 14 {
+		t.Errorf("got listeners %+v", c.Listeners)
+	}
+	if len(c.Policy.Rules) != 2 || c.Policy.Rules[1].Line != 9 {
+		t.Errorf("got rules %v", c.Policy.Rules)
+	}
+	if time.Duration(c.Timeouts.Idle) != time.Minute || time.Duration(c.Timeouts.Dial) != 30*time.Second {
+		t.Errorf("got timeouts %+v", c.Timeouts)
+	}
+	// Flag defaults fill in what the file doesn't set
+	if len(c.RestrictedPorts) != 1 || c.RestrictedPorts[0] != 25 {
+		t.Errorf("got restrictedPorts %v", c.RestrictedPorts)
+	}
+	if nets, err := c.deniedNets(); err != nil || !nets[len(nets)-1].Contains([]byte{192, 0, 2, 1}) {
+		t.Errorf("got deniedNets %v, %v", nets, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		conf, want string
+	}{
+		{"hostname: x\nfoo: bar\n", "line 2: field foo not found"},
+		{"hostname: x\ntimeouts:\n  dial: 1y\n", "line 3:"},
+		{"hostname: x\npolicy:\n  rules:\n    - allow\n    - deny port=x\n", "line 5: bad port"},
+		{"hostname: x\npolicy:\n  rules:\n    - allow\n    - \"\"\n", "line 5: empty rule"},
+		{"hostname: x\npolicy:\n  rules:\n    -\n    - allow\n", "line 4: empty rule"},
+		{"hostname: x\nauth:\n  username: u\n  password: p\nlisteners:\n  - addr: :80\n  - addr: :81\n    authSchemes: [NTLM]\n", "line 7: Unknown auth scheme"},
+		{"hostname: x\nauth:\n  htpasswd: f\nlisteners:\n  - addr: :80\n    authSchemes: [Digest]\n", "line 5: Digest auth requires"},
+		{"hostname: x\n", "Please specify --username"},
+		{"hostname: x\nauth:\n  username: u\n  passwordHash: $pbkdf2-sha256$0$c2FsdA$a2V5\n", "auth: passwordHash: unsupported or malformed hash"},
+		{"hostname: x\nauth:\n  jwks: f\nlisteners:\n  - addr: :1080\n    protocol: socks\n", "line 5: socks auth requires"},
+		{"hostname: x\nlisteners:\n  - addr: unix:/tmp/a\n    allowAnonymous: true\n  - addr: :80\n", "Please specify --username"},
+		{"hostname: x\nauth:\n  htpasswd: f\nlisteners:\n  - addr: \"unix:\"\n", "line 5: addr: \"unix:\" has no path"},
+		{"hostname: x\nauth:\n  htpasswd: f\nlisteners:\n  - addr: localhost\n", "line 5: addr: address localhost: missing port"},
+		{"hostname: 192.0.2.1:8443\nauth:\n  htpasswd: f\nacme:\n  enabled: true\n", "acme requires --hostname to be a DNS name"},
+		{"hostname: x\nauth:\n  htpasswd: f\nupstreams:\n  corp:\n    url: http://proxy:3128\nroutes:\n  - direct host=*.corp\n  - copr\n", "routes: line 9: unknown upstream \"copr\""},
+		{"hostname: x\nauth:\n  htpasswd: f\nupstreams:\n  corp:\n    url: ftp://proxy\n", "line 6: upstreams: corp: unsupported upstream scheme"},
+		{"hostname: x\nauth:\n  htpasswd: f\nupstreams:\n  corp:\n    url: http://proxy:3128\n  backup:\n    url: http://backup:3128\n    weight: -1\n", "line 8: upstreams: backup: weight must not be negative"},
+		{"hostname: x\nauth:\n  htpasswd: f\nupstreams:\n  corp:\n    url: http://proxy:3128\npools:\n  all: [corp, other]\n", "line 8: pools: all: unknown upstream \"other\""},
+		{"hostname: x\nauth:\n  htpasswd: f\nupstreams:\n  corp:\n    url: http://proxy:3128\npools:\n  corp: [corp]\n", "line 8: pools: corp: name taken"},
+		{"hostname: x\nauth:\n  htpasswd: f\naccessLog:\n  format: xml\n", "accessLog: Unknown format \"xml\""},
+		{"hostname: x\nauth:\n  htpasswd: f\ntracing:\n  endpoint: localhost:4318\n", "tracing: endpoint must be an http or https URL"},
+		{"hostname: x\nauth:\n  htpasswd: f\ntracing:\n  sampleRatio: 2\n", "tracing: sampleRatio must be between 0 and 1"},
+		{"hostname: x\nauth:\n  htpasswd: f\ntls:\n  cert: c\n  key: k\nacme:\n  enabled: true\n", "acme and --cert are exclusive"},
+	} {
+		p := writeConfig(t, c.conf)
+		_, err := loadConfig(p)
+		os.Remove(p)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v want %q", c.conf, err, c.want)
+		}
+	}
+}
+
+func TestACMEChallengeable(t *testing.T) {
+	for _, tc := range []struct {
+		listeners []listenerConfig
+		want      bool
+	}{
+		{[]listenerConfig{{Addr: ":8080", Protocol: protoHTTP}, {Addr: ":8443", Protocol: protoHTTP, TLS: true}}, false},
+		{[]listenerConfig{{Addr: ":443", Protocol: protoHTTP}}, false},
+		{[]listenerConfig{{Addr: ":80", Protocol: protoHTTP}}, true},
+		{[]listenerConfig{{Addr: ":https", Protocol: protoHTTP, TLS: true}}, true},
+		{[]listenerConfig{{Addr: "systemd:proxy", Protocol: protoHTTP}}, true},
+	} {
+		c := &config{Listeners: tc.listeners}
+		if got := c.acmeChallengeable(); got != tc.want {
+			t.Errorf("%+v: got %v", tc.listeners, got)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tsawada/javertd/lib"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// listener is a configured listener whose Server and client CAs are
+// replaced on reload.
+type listener struct {
+	conf      listenerConfig
+	handler   *lib.AtomicServer
+	clientCAs atomic.Value // *x509.CertPool
+}
+
+// daemon holds the running configuration. Reloading swaps Servers and
+// certificates atomically; listeners and established connections are kept.
+type daemon struct {
+	mu        sync.Mutex
+	conf      *config
+	getCert   atomic.Value // func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	acme      atomic.Value // *autocert.Manager
+	issuer    *lib.LeafIssuer
+	listeners []*listener
+	tracker   lib.Tracker
+	accessLog lib.AccessLog
+	metrics   lib.Metrics
+	digest    lib.DigestAuth
+	tp        *sdktrace.TracerProvider // Exports spans, if tracing is on
+
+	stopChecks context.CancelFunc // Stops probing the upstreams of conf
+}
+
+func newServers(conf *config, routes []*lib.Route) ([]*lib.Server, error) {
+	var cred lib.Credentials
+	var tokens lib.TokenVerifier
+	var policy *lib.Policy
+	var err error
+	if conf.Auth.Htpasswd != "" {
+		if cred, err = lib.LoadHtpasswd(conf.Auth.Htpasswd); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Auth.JWKS != "" {
+		v, err := lib.LoadJWKS(conf.Auth.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		v.Audience = conf.Auth.JWTAudience
+		v.Issuer = conf.Auth.JWTIssuer
+		v.Claims = conf.Auth.JWTClaims
+		tokens = v
+	}
+	if conf.Policy.File != "" {
+		if policy, err = lib.LoadPolicy(conf.Policy.File); err != nil {
+			return nil, err
+		}
+	} else if len(conf.Policy.Rules) > 0 {
+		policy = lib.NewPolicy(conf.Policy.Rules)
+	}
+	nets, err := conf.deniedNets()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]*lib.Server, len(conf.Listeners))
+	for i, l := range conf.Listeners {
+		s := &lib.Server{
+			User:            conf.Auth.Username,
+			Pass:            conf.Auth.Password,
+			PassHash:        conf.Auth.PasswordHash,
+			Host:            conf.Hostname,
+			RestrictedPorts: make(map[int]struct{}, len(conf.RestrictedPorts)),
+			Credentials:     cred,
+			Tokens:          tokens,
+			Policy:          policy,
+			DeniedNets:      nets,
+			DialTimeout:     time.Duration(conf.Timeouts.Dial),
+			AuthSchemes:     l.AuthSchemes,
+			Admins:          conf.Auth.Admins,
+			ClientCertAuth:  l.ClientCA != "",
+			AllowAnonymous:  l.AllowAnonymous,
+			Routes:          routes,
+			PropagateTrace:  conf.Tracing.Propagate,
+		}
+		for _, p := range conf.RestrictedPorts {
+			s.RestrictedPorts[p] = struct{}{}
+		}
+		servers[i] = s
+	}
+	return servers, nil
+}
+
+// localCA returns an issuer of certificates for conf.Hostname from the
+// local CA. It's kept across reloads unless the settings change, so that
+// the certificate is only renewed when due.
+func (d *daemon) localCA(conf *config) (*lib.LeafIssuer, error) {
+	names := conf.certNames()
+	if d.issuer != nil && d.conf.LocalCA.Dir == conf.LocalCA.Dir && d.issuer.Validity == time.Duration(conf.LocalCA.Validity) &&
+		strings.Join(d.issuer.Names, ",") == strings.Join(names, ",") && d.conf.TLS.PassphraseFile == conf.TLS.PassphraseFile {
+		return d.issuer, nil
+	}
+	passphrase, err := conf.keyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	ca, err := lib.LoadCA(&lib.KeyStore{Dir: conf.LocalCA.Dir, Passphrase: passphrase})
+	if err != nil {
+		return nil, err
+	}
+	return &lib.LeafIssuer{CA: ca, Names: names, Validity: time.Duration(conf.LocalCA.Validity)}, nil
+}
+
+// acmeManager returns the ACME certificate manager for conf. It's kept
+// across reloads unless the ACME settings change.
+func (d *daemon) acmeManager(conf *config) (*autocert.Manager, error) {
+	if old, _ := d.acme.Load().(*autocert.Manager); old != nil && d.conf.ACME == conf.ACME && d.conf.hostname() == conf.hostname() {
+		return old, nil
+	}
+	client := &acme.Client{DirectoryURL: conf.ACME.Directory}
+	if conf.ACME.CA != "" {
+		pool, err := lib.LoadCertPool(conf.ACME.CA)
+		if err != nil {
+			return nil, err
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: t}
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(conf.ACME.Cache),
+		HostPolicy: autocert.HostWhitelist(conf.hostname()),
+		Email:      conf.ACME.Email,
+		Client:     client,
+	}
+	// autocert only tries http-01 once asked for its handler.
+	m.HTTPHandler(nil)
+	return m, nil
+}
+
+// acmeHandler answers ACME http-01 challenges, which arrive as origin-form
+// requests, and passes everything else to h.
+func (d *daemon) acmeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m, _ := d.acme.Load().(*autocert.Manager)
+		if m != nil && !req.URL.IsAbs() && strings.HasPrefix(req.URL.Path, "/.well-known/acme-challenge/") {
+			m.HTTPHandler(nil).ServeHTTP(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// apply builds everything conf needs and swaps it in. On error nothing
+// is changed.
+func (d *daemon) apply(conf *config) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listeners != nil {
+		if len(conf.Listeners) != len(d.listeners) {
+			return errors.New("listeners changed; restart required")
+		}
+		for i, l := range conf.Listeners {
+			if old := d.listeners[i].conf; l.Addr != old.Addr || l.TLS != old.TLS || l.Protocol != old.Protocol {
+				return errors.New("listeners changed; restart required")
+			}
+		}
+	}
+
+	routes, upstreams, err := conf.routes()
+	if err != nil {
+		return err
+	}
+	servers, err := newServers(conf, routes)
+	if err != nil {
+		return err
+	}
+	for _, s := range servers {
+		s.Tracker = &d.tracker
+		s.AccessLog = &d.accessLog
+		s.Metrics = &d.metrics
+		s.Digest = &d.digest
+	}
+	for _, u := range upstreams {
+		u.Metrics = &d.metrics
+	}
+	var getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	var m *autocert.Manager
+	var issuer *lib.LeafIssuer
+	switch {
+	case conf.ACME.Enabled:
+		if m, err = d.acmeManager(conf); err != nil {
+			return err
+		}
+		getCert = m.GetCertificate
+	case conf.TLS.Cert != "":
+		passphrase, err := conf.keyPassphrase()
+		if err != nil {
+			return err
+		}
+		cert, err := lib.LoadKeyPair(conf.TLS.Cert, conf.TLS.Key, passphrase)
+		if err != nil {
+			return err
+		}
+		getCert = func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }
+	default:
+		if issuer, err = d.localCA(conf); err != nil {
+			return err
+		}
+		// Issue now to report problems at startup rather than on handshake.
+		if _, err := issuer.GetCertificate(nil); err != nil {
+			return err
+		}
+		getCert = issuer.GetCertificate
+	}
+	pools := make([]*x509.CertPool, len(conf.Listeners))
+	for i, l := range conf.Listeners {
+		if l.ClientCA == "" {
+			continue
+		}
+		if pools[i], err = lib.LoadCertPool(l.ClientCA); err != nil {
+			return err
+		}
+	}
+
+	tp, err := d.tracerProvider(conf)
+	if err != nil {
+		return err
+	}
+	if tp != nil {
+		for _, s := range servers {
+			s.TracerProvider = tp
+		}
+	}
+	// Reopened on every reload, in case it's been rotated by something else
+	logOut, err := openAccessLog(conf.AccessLog)
+	if err != nil {
+		if tp != nil && tp != d.tp {
+			tp.Shutdown(context.Background())
+		}
+		return err
+	}
+
+	if d.listeners == nil {
+		for _, l := range conf.Listeners {
+			d.listeners = append(d.listeners, &listener{conf: l, handler: &lib.AtomicServer{}})
+		}
+	}
+	for i, l := range d.listeners {
+		l.conf = conf.Listeners[i]
+		l.clientCAs.Store(pools[i])
+		l.handler.Store(servers[i])
+	}
+	d.accessLog.SetOutput(conf.AccessLog.Format, logOut)
+	d.getCert.Store(getCert)
+	d.acme.Store(m)
+	d.issuer = issuer
+	if d.tp != nil && d.tp != tp {
+		go d.tp.Shutdown(context.Background())
+	}
+	d.tp = tp
+	d.conf = conf
+
+	if d.stopChecks != nil {
+		d.stopChecks()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.stopChecks = cancel
+	if interval := time.Duration(conf.UpstreamCheck.Interval); interval > 0 {
+		for _, u := range upstreams {
+			go u.HealthCheck(ctx, interval, conf.UpstreamCheck.URL)
+		}
+	}
+	return nil
+}
+
+// tracerProvider returns the provider exporting spans as configured by
+// conf, or nil if tracing is off. It's kept across reloads unless the
+// tracing settings change.
+func (d *daemon) tracerProvider(conf *config) (*sdktrace.TracerProvider, error) {
+	c := conf.Tracing
+	if d.conf != nil && d.conf.Tracing.Endpoint == c.Endpoint && d.conf.Tracing.SampleRatio == c.SampleRatio {
+		return d.tp, nil
+	}
+	if c.Endpoint == "" {
+		return nil, nil
+	}
+	exp, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(c.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "javertd"))),
+	), nil
+}
+
+// stdout is standard output as an access log, which is never closed.
+type stdout struct {
+	io.Writer
+}
+
+func (stdout) Close() error {
+	return nil
+}
+
+// openAccessLog opens the output of c, or returns nil if it's disabled.
+func openAccessLog(c accessLogConfig) (io.WriteCloser, error) {
+	switch c.File {
+	case "":
+		return nil, nil
+	case "-":
+		return stdout{os.Stdout}, nil
+	}
+	f, err := lib.OpenRotatingFile(c.File, int64(c.MaxSize)<<20, c.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *daemon) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return d.getCert.Load().(func(*tls.ClientHelloInfo) (*tls.Certificate, error))(hello)
+}
+
+// tlsConfig returns the TLS configuration of l, which follows reloads.
+func (d *daemon) tlsConfig(l *listener) *tls.Config {
+	base := &tls.Config{
+		GetCertificate: d.getCertificate,
+		// acme.ALPNProto lets ACME servers validate with tls-alpn-01.
+		NextProtos: []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		pool := l.clientCAs.Load().(*x509.CertPool)
+		// ACME servers validating tls-alpn-01 have no client certificate.
+		if pool == nil || (len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto) {
+			return nil, nil
+		}
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		return c, nil
+	}
+	return base
+}
+
+func (d *daemon) reload() {
+	conf, err := loadConfig(*configFile)
+	if err == nil {
+		err = d.apply(conf)
+	}
+	if err != nil {
+		log.Printf("Reload failed: %v", err)
+		return
+	}
+	log.Printf("Reloaded configuration")
+}
+
+func (d *daemon) reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		d.reload()
+	}
+}
+
+// files lists the files the running configuration was read from.
+func (d *daemon) files() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.conf
+	l := []string{c.path, c.Auth.Htpasswd, c.Auth.JWKS, c.Policy.File, c.TLS.Cert, c.TLS.Key, c.TLS.PassphraseFile}
+	var cas []string
+	for _, u := range c.Upstreams {
+		cas = append(cas, u.CA)
+	}
+	sort.Strings(cas) // Stable for fileStamp
+	l = append(l, cas...)
+	for _, ln := range c.Listeners {
+		l = append(l, ln.ClientCA)
+	}
+	return l
+}
+
+func fileStamp(files []string) string {
+	var b strings.Builder
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// watch polls the configuration files and reloads when any of them changes.
+func (d *daemon) watch(interval time.Duration) {
+	last := fileStamp(d.files())
+	for range time.Tick(interval) {
+		if s := fileStamp(d.files()); s != last {
+			last = s
+			d.reload()
+		}
+	}
+}
+
+// shutdown stops servers and SOCKS listeners from accepting, waits up to
+// grace for requests and tunnels in flight to finish, and then closes
+// everything left and flushes traces.
+func (d *daemon) shutdown(servers []*http.Server, socks []net.Listener, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		s := s
+		wg.Add(1)
+		go func() {
+			s.Shutdown(ctx)
+			wg.Done()
+		}()
+	}
+	for _, l := range socks {
+		l.Close()
+	}
+	log.Printf("Shutting down; draining %d connections", d.tracker.Active())
+	cut := d.tracker.Drain(ctx)
+	for _, s := range servers {
+		s.Close()
+	}
+	wg.Wait()
+	d.mu.Lock()
+	tp := d.tp
+	d.mu.Unlock()
+	if tp != nil {
+		// Flush spans, with a fresh deadline as draining may have used up ctx.
+		fctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		tp.Shutdown(fctx)
+		cancel()
+	}
+	log.Printf("Shut down; %d connections cut", cut)
+}
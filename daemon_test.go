@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const acmeDomain = "proxy.example.test"
+
+// fakeACME is a minimal RFC 8555 CA issuing certificates for acmeDomain.
+// It offers only challenge, validated against httpAddr (http-01) or tlsAddr
+// (tls-alpn-01) instead of the addresses acmeDomain resolves to.
+type fakeACME struct {
+	*httptest.Server
+	challenge, httpAddr, tlsAddr string
+	ca                           *x509.Certificate
+	caKey                        *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	nonce  int
+	status string // Of the authorization
+	cert   []byte
+}
+
+func newFakeACME(t *testing.T, challenge, httpAddr, tlsAddr string) *fakeACME {
+	f := &fakeACME{challenge: challenge, httpAddr: httpAddr, tlsAddr: tlsAddr, status: "pending"}
+	var err error
+	if f.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &f.caKey.PublicKey, f.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ca, _ = x509.ParseCertificate(der)
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", f.nonce))
+	w.Header().Set("Content-Type", "application/json")
+	var jws struct{ Payload string }
+	json.NewDecoder(req.Body).Decode(&jws)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	reply := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	switch req.URL.Path {
+	case "/dir":
+		reply(http.StatusOK, map[string]string{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/account",
+			"newOrder":   f.URL + "/order",
+			"revokeCert": f.URL + "/revoke",
+			"keyChange":  f.URL + "/keychange",
+		})
+	case "/nonce":
+	case "/account":
+		w.Header().Set("Location", f.URL+"/account/1")
+		reply(http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		w.Header().Set("Location", f.URL+"/order/1")
+		reply(http.StatusCreated, f.order())
+	case "/order/1":
+		reply(http.StatusOK, f.order())
+	case "/authz/1":
+		reply(http.StatusOK, map[string]interface{}{
+			"status":     f.status,
+			"identifier": map[string]string{"type": "dns", "value": acmeDomain},
+			"challenges": []interface{}{f.chal()},
+		})
+	case "/chal/1":
+		if f.validate() {
+			f.status = "valid"
+		} else {
+			f.status = "invalid"
+		}
+		reply(http.StatusOK, f.chal())
+	case "/finalize/1":
+		var v struct{ CSR string }
+		json.Unmarshal(payload, &v)
+		b, _ := base64.RawURLEncoding.DecodeString(v.CSR)
+		csr, err := x509.ParseCertificateRequest(b)
+		if err != nil {
+			reply(http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR"})
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if f.cert, err = x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.caKey); err != nil {
+			reply(http.StatusInternalServerError, map[string]string{"type": "urn:ietf:params:acme:error:serverInternal"})
+			return
+		}
+		w.Header().Set("Location", f.URL+"/order/1")
+		reply(http.StatusOK, f.order())
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (f *fakeACME) order() map[string]interface{} {
+	o := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []map[string]string{{"type": "dns", "value": acmeDomain}},
+		"authorizations": []string{f.URL + "/authz/1"},
+		"finalize":       f.URL + "/finalize/1",
+	}
+	switch {
+	case f.cert != nil:
+		o["status"] = "valid"
+		o["certificate"] = f.URL + "/cert/1"
+	case f.status == "valid":
+		o["status"] = "ready"
+	case f.status == "invalid":
+		o["status"] = "invalid"
+	}
+	return o
+}
+
+func (f *fakeACME) chal() map[string]string {
+	return map[string]string{"type": f.challenge, "url": f.URL + "/chal/1", "token": "token1", "status": f.status}
+}
+
+// idPeAcmeIdentifier is the extension of tls-alpn-01 certificates.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// validate checks the response to the challenge as a CA would.
+func (f *fakeACME) validate() bool {
+	switch f.challenge {
+	case "http-01":
+		req, _ := http.NewRequest("GET", "http://"+f.httpAddr+"/.well-known/acme-challenge/token1", nil)
+		req.Host = acmeDomain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode == http.StatusOK && bytes.HasPrefix(b, []byte("token1."))
+	case "tls-alpn-01":
+		c, err := tls.Dial("tcp", f.tlsAddr, &tls.Config{ServerName: acmeDomain, NextProtos: []string{acme.ALPNProto}, InsecureSkipVerify: true})
+		if err != nil {
+			return false
+		}
+		defer c.Close()
+		st := c.ConnectionState()
+		if st.NegotiatedProtocol != acme.ALPNProto || len(st.PeerCertificates) == 0 {
+			return false
+		}
+		for _, e := range st.PeerCertificates[0].Extensions {
+			if e.Id.Equal(idPeAcmeIdentifier) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestACME(t *testing.T) {
+	for _, challenge := range []string{"http-01", "tls-alpn-01"} {
+		dir, err := ioutil.TempDir("", "javertd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		d := &daemon{}
+		plain := httptest.NewServer(d.acmeHandler(http.NotFoundHandler()))
+		defer plain.Close()
+		// With a clientCA, which tls-alpn-01 validation must bypass
+		l := &listener{conf: listenerConfig{Addr: "127.0.0.1:0", TLS: true, ClientCA: "ca.pem"}}
+		l.clientCAs.Store(x509.NewCertPool())
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				tc := tls.Server(c, d.tlsConfig(l))
+				tc.Handshake()
+				tc.Close()
+			}
+		}()
+
+		f := newFakeACME(t, challenge, plain.Listener.Addr().String(), ln.Addr().String())
+		defer f.Close()
+		conf := &config{Hostname: acmeDomain, ACME: acmeConfig{Enabled: true, Directory: f.URL + "/dir", Cache: dir}}
+		m, err := d.acmeManager(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.acme.Store(m)
+		d.getCert.Store(m.GetCertificate)
+
+		cert, err := d.getCertificate(&tls.ClientHelloInfo{ServerName: acmeDomain})
+		if err != nil {
+			t.Errorf("%s: %v", challenge, err)
+			continue
+		}
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil || strings.Join(leaf.DNSNames, ",") != acmeDomain || leaf.Issuer.CommonName != "fake ACME CA" {
+			t.Errorf("%s: got %v, %v", challenge, leaf, err)
+		}
+	}
+}
@@ -1,98 +1,185 @@
 package main
 
 import (
-	"crypto/tls"
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tsawada/javertd/lib"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/term"
 )
 
 var (
-	port            = flag.Int("port", 1080, "HTTP port")
+	port            = flag.Int("port", 1080, "HTTP port, or 0 to disable")
 	host            = flag.String("hostname", "", "Serve Proxy on this hostname")
 	user            = flag.String("username", "", "Username for Proxy auth")
 	pass            = flag.String("password", "", "Password for Proxy auth")
+	passHash        = flag.String("passwordHash", "", "Password hash for Proxy auth (see 'javertd hashpw')")
+	htpasswd        = flag.String("htpasswd", "", "htpasswd file for Proxy auth")
+	jwks            = flag.String("jwks", "", "JWKS file to verify Bearer tokens for Proxy auth")
+	jwtAudience     = flag.String("jwtAudience", "", "Required aud claim of Bearer tokens")
+	jwtIssuer       = flag.String("jwtIssuer", "", "Required iss claim of Bearer tokens")
+	jwtClaims       = flag.String("jwtClaims", "", "Comma separated list of required claim=value of Bearer tokens")
+	admins          = flag.String("admins", "", "Comma separated users allowed on the status page and the /conns API (default --username)")
 	certFile        = flag.String("cert", "", "Certificate file")
 	keyFile         = flag.String("key", "", "Key file")
-	restrictedPorts = flag.String("restrictedPorts", "25", "List of port numbers CONNECT won't connect")
-	parsedRePorts   []int
+	clientCA        = flag.String("clientCA", "", "CA bundle to require and verify client certificates on the TLS port. Verified clients skip Proxy auth")
+	authSchemes     = flag.String("authSchemes", "", "Comma separated Proxy auth schemes (Basic, Digest, Bearer) on --port (default Basic, and Bearer with --jwks)")
+	tlsAuthSchemes  = flag.String("tlsAuthSchemes", "", "Comma separated Proxy auth schemes (Basic, Digest, Bearer) on the TLS port (default Basic, and Bearer with --jwks)")
+	deniedNets      = flag.String("deniedNets", "default", "Comma separated CIDRs no client may connect to. \"default\" denies loopback, private and link-local ranges, \"none\" allows everything")
+	policyFile      = flag.String("policy", "", "Destination policy file")
+	upstream        = flag.String("upstream", "", "Comma separated parent proxy URLs (http, https or socks5, with user:password@ if required) to send all requests and tunnels through, failing over between them")
+	checkInterval   = flag.Duration("upstreamCheckInterval", 10*time.Second, "How often to probe upstreams, or 0 to only avoid them for a while after a failure")
+	checkURL        = flag.String("upstreamCheckURL", "", "URL to get through upstreams to probe them. By default probes only connect")
+	restrictedPorts = flag.String("restrictedPorts", "25", "List of port numbers the proxy won't connect")
+	tlsPort         = flag.Int("tlsPort", 8443, "HTTPS port, or 0 to disable")
+	socksPort       = flag.Int("socksPort", 0, "SOCKS5 and SOCKS4(a) port, or 0 to disable. SOCKS4 clients send user:password as the user ID")
+	adminPort       = flag.Int("adminPort", 0, "Port on localhost serving the status page (JSON with ?format=json), /metrics and the /conns API to list and kill tunnels, or 0 to disable")
+	configFile      = flag.String("config", "", "YAML configuration file. Flags override its values. Everything is reloaded on SIGHUP")
+	watchInterval   = flag.Duration("watch", 0, "Reload when the configuration or files it refers to change, polling at this interval")
+	caDir           = flag.String("caDir", ".", "Directory of the local CA (ca.pem, ca-key.pem) issuing the certificate without --cert or --acme. Created if missing")
+	certValidity    = flag.Duration("certValidity", 7*24*time.Hour, "Validity of certificates issued by the local CA. They're renewed when a third remains")
+	certNames       = flag.String("certNames", "", "Comma separated DNS names and IP addresses to include in the certificate besides --hostname")
+	keyPassphrase   = flag.String("keyPassphraseFile", "", "File holding the passphrase of --key and of the local CA's key, which is then written encrypted")
+	acmeEnabled     = flag.Bool("acme", false, "Obtain and renew the certificate for --hostname with ACME instead of --cert and --key. Challenges need --port 80 or --tlsPort 443")
+	acmeDirectory   = flag.String("acmeDirectory", acme.LetsEncryptURL, "ACME directory URL")
+	acmeEmail       = flag.String("acmeEmail", "", "Contact email for the ACME account")
+	acmeCache       = flag.String("acmeCache", "acme-cache", "Directory to keep the ACME account key and certificates in")
+	acmeCA          = flag.String("acmeCA", "", "CA bundle to verify the ACME server with, such as a test server's")
+	accessLog       = flag.String("accessLog", "", "File to log every request and tunnel to, or - for standard output")
+	accessLogFormat = flag.String("accessLogFormat", lib.LogCombined, "Access log format: combined, common, json or logfmt")
+	logMaxSize      = flag.Int("accessLogMaxSize", 100, "Size in megabytes at which the access log is rotated, or 0 to never rotate")
+	logMaxBackups   = flag.Int("accessLogMaxBackups", 5, "Rotated access logs to keep")
+	otlpEndpoint    = flag.String("otlpEndpoint", "", "OTLP/HTTP collector URL to export traces to, such as http://localhost:4318. Tracing is off without")
+	propagateTrace  = flag.Bool("propagateTrace", false, "Send W3C traceparent on forwarded HTTP requests")
+	traceRatio      = flag.Float64("traceSampleRatio", 1, "Share of requests to trace, unless the client sent traceparent")
+	shutdownGrace   = flag.Duration("shutdownGrace", 30*time.Second, "On SIGTERM, how long to let requests and tunnels in flight finish")
 )
 
-func flagCheck() error {
-	flag.Parse()
-	if *user == "" || *pass == "" {
-		return errors.New("Please specify --username and --password")
-	}
-	if *host == "" {
-		return errors.New("Please specify --hostname")
+// splitList splits a comma separated flag value. An empty value yields nil.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
 	}
-	l := strings.Split(*restrictedPorts, ",")
-	parsedRePorts := make([]int, len(l))
-	for i, v := range l {
-		n, err := strconv.Atoi(v)
+	return strings.Split(s, ",")
+}
+
+// hashpw reads a password from stdin and prints its hash.
+func hashpw(args []string) error {
+	fs := flag.NewFlagSet("hashpw", flag.ExitOnError)
+	algo := fs.String("algo", lib.HashBcrypt, "Hash algorithm: bcrypt, argon2id or pbkdf2")
+	fs.Parse(args)
+
+	var pw []byte
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
 		if err != nil {
-			return errors.New("Bad port in --restrictedPorts")
+			return err
+		}
+		pw = b
+	} else {
+		b, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
 		}
-		parsedRePorts[i] = n
+		pw = []byte(strings.TrimRight(b, "\r\n"))
+	}
+	if len(pw) == 0 {
+		return errors.New("Empty password")
 	}
+	h, err := lib.HashPassword(*algo, string(pw))
+	if err != nil {
+		return err
+	}
+	fmt.Println(h)
 	return nil
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	if err := flagCheck(); err != nil {
+	if len(os.Args) > 1 && os.Args[1] == "hashpw" {
+		if err := hashpw(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	flag.Parse()
+	conf, err := loadConfig(*configFile)
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		os.Exit(1)
 	}
-	m := &lib.Server{
-		User:            *user,
-		Pass:            *pass,
-		Host:            *host,
-		RestrictedPorts: make(map[int]struct{}, len(parsedRePorts)),
+	d := &daemon{}
+	if err := d.apply(conf); err != nil {
+		log.Fatal(err)
 	}
-	for _, i := range parsedRePorts {
-		m.RestrictedPorts[i] = struct{}{}
+	go d.reloadOnHangup()
+	if *watchInterval > 0 {
+		go d.watch(*watchInterval)
 	}
-	c := make(chan struct{})
-	go func() {
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), m))
-		c <- struct{}{}
-	}()
-	go func() {
-		var certificate tls.Certificate
-		if *keyFile != "" && *certFile != "" {
+
+	var servers []*http.Server
+	var socks []net.Listener
+	for _, l := range d.listeners {
+		ln, err := listen(l.conf.Addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Listening on %s (%s)", l.conf.Addr, l.conf.Protocol)
+		if l.conf.Protocol == protoSOCKS {
+			socks = append(socks, ln)
+			go func(l *listener) {
+				if err := l.handler.ServeSOCKS(ln); !errors.Is(err, net.ErrClosed) {
+					log.Fatal(err)
+				}
+			}(l)
+			continue
+		}
+		handler := d.acmeHandler(l.handler)
+		if l.conf.Protocol == protoAdmin {
+			handler = l.handler.AdminHandler()
+		}
+		s := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: time.Duration(conf.Timeouts.ReadHeader),
+			IdleTimeout:       time.Duration(conf.Timeouts.Idle),
+		}
+		if l.conf.TLS {
+			s.TLSConfig = d.tlsConfig(l)
+		}
+		servers = append(servers, s)
+		go func() {
 			var err error
-			certificate, err = tls.LoadX509KeyPair(*certFile, *keyFile)
-			if err != nil {
-				log.Fatal(err)
+			if s.TLSConfig == nil {
+				err = s.Serve(ln)
+			} else {
+				err = s.ServeTLS(ln, "", "")
 			}
-		} else {
-			cert, privKey := lib.SelfSigned(strings.Split(*host, ":")[0])
-			certificate = tls.Certificate{
-				Certificate: [][]byte{cert},
-				PrivateKey:  privKey,
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
 			}
-			ioutil.WriteFile("privkey.pem", lib.PrivToPem(privKey), 0644)
-			ioutil.WriteFile("cert.pem", lib.CertToPem(cert), 0644)
-		}
-		s := http.Server{
-			Addr:    ":8443",
-			Handler: m,
-			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{certificate},
-			},
-		}
-		log.Fatal(s.ListenAndServeTLS("", ""))
-		c <- struct{}{}
-	}()
-	<-c
+		}()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
 	<-c
+	d.mu.Lock()
+	grace := time.Duration(d.conf.Timeouts.Shutdown)
+	d.mu.Unlock()
+	d.shutdown(servers, socks, grace)
 }
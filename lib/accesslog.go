@@ -0,0 +1,371 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Access log formats
+const (
+	LogCommon   = "common"   // Apache Common Log Format
+	LogCombined = "combined" // Apache Combined Log Format
+	LogJSON     = "json"     // A JSON object per line
+	LogLogfmt   = "logfmt"   // key=value pairs per line
+)
+
+// AccessLog writes an entry for every request and tunnel once it's done.
+// One AccessLog is shared by Servers replacing each other on reload. A nil
+// AccessLog, or one without output, logs nothing.
+type AccessLog struct {
+	mu     sync.Mutex
+	format string
+	w      io.WriteCloser
+}
+
+// SetOutput makes l write entries in format to w, closing the previous
+// output. A nil w disables l.
+func (l *AccessLog) SetOutput(format string, w io.WriteCloser) {
+	l.mu.Lock()
+	old := l.w
+	l.format, l.w = format, w
+	l.mu.Unlock()
+	if old != nil && old != w {
+		old.Close()
+	}
+}
+
+func (l *AccessLog) enabled() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w != nil
+}
+
+// accessRecord collects what's logged about a request as it's served.
+type accessRecord struct {
+	start    time.Time
+	up, down int64 // Bytes from and to the client, updated atomically
+
+	mu     sync.Mutex
+	status int
+	reason string
+}
+
+const recordKey contextKey = 2
+
+func recordOf(req *http.Request) *accessRecord {
+	rec, _ := req.Context().Value(recordKey).(*accessRecord)
+	return rec
+}
+
+// logStatus records the status of req, unless one is already recorded.
+func logStatus(req *http.Request, status int) {
+	if rec := recordOf(req); rec != nil {
+		rec.mu.Lock()
+		if rec.status == 0 {
+			rec.status = status
+		}
+		rec.mu.Unlock()
+	}
+}
+
+// logReason records why req ended, unless a reason is already recorded.
+func logReason(req *http.Request, reason string) {
+	if rec := recordOf(req); rec != nil {
+		rec.mu.Lock()
+		if rec.reason == "" {
+			rec.reason = reason
+		}
+		rec.mu.Unlock()
+	}
+}
+
+// logBytes adds bytes relayed for a tunnel.
+func logBytes(req *http.Request, up, down int64) {
+	if rec := recordOf(req); rec != nil {
+		atomic.AddInt64(&rec.up, up)
+		atomic.AddInt64(&rec.down, down)
+	}
+}
+
+// record begins recording req, including the size of its body, for the
+// access log, metrics, status page and tracing.
+func (srv *Server) record(req *http.Request) *http.Request {
+	if !srv.AccessLog.enabled() && srv.Metrics == nil && srv.Tracker == nil && srv.TracerProvider == nil {
+		return req
+	}
+	req = srv.startTrace(req)
+	rec := &accessRecord{start: time.Now()}
+	req = req.WithContext(context.WithValue(req.Context(), recordKey, rec))
+	if req.Body != nil {
+		req.Body = &countingReader{req.Body, &rec.up}
+	}
+	return req
+}
+
+// recordResponse wraps w to record the status and size of the response
+// to req, if req is being recorded.
+func recordResponse(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	rec := recordOf(req)
+	if rec == nil {
+		return w
+	}
+	rw := &recordingWriter{w, rec}
+	if _, ok := w.(http.Hijacker); ok {
+		return &hijackingWriter{rw}
+	}
+	return rw
+}
+
+// countBytes returns w counting what's written as relayed up (from the
+// client) or down for req.
+func countBytes(req *http.Request, w io.Writer, up bool) io.Writer {
+	rec := recordOf(req)
+	if rec == nil {
+		return w
+	}
+	if up {
+		return &countingWriter{w, &rec.up}
+	}
+	return &countingWriter{w, &rec.down}
+}
+
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// recordingWriter records the status and size of a response. It's a
+// Flusher and CloseNotifier, and hijackingWriter is also a Hijacker, as
+// handlers check for those.
+type recordingWriter struct {
+	http.ResponseWriter
+	rec *accessRecord
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.rec.mu.Lock()
+	if w.rec.status == 0 {
+		w.rec.status = status
+	}
+	w.rec.mu.Unlock()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.rec.mu.Lock()
+	if w.rec.status == 0 {
+		w.rec.status = http.StatusOK
+	}
+	w.rec.mu.Unlock()
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(&w.rec.down, int64(n))
+	return n, err
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+type hijackingWriter struct {
+	*recordingWriter
+}
+
+func (w *hijackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// accessEntry is what's logged about a request.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Target    string    `json:"target"`
+	Proto     string    `json:"proto,omitempty"`
+	Status    int       `json:"status"`
+	BytesUp   int64     `json:"bytesUp"`
+	BytesDown int64     `json:"bytesDown"`
+	Duration  float64   `json:"duration"` // Seconds
+	Reason    string    `json:"reason"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// target returns what req asked for: host:port for tunnels, the URL
+// otherwise.
+func target(req *http.Request) string {
+	if req.Method == "CONNECT" || req.URL == nil {
+		return req.Host
+	}
+	if req.URL.Host == "" {
+		return req.URL.RequestURI()
+	}
+	return req.URL.String()
+}
+
+// recordDone logs, counts and ends the trace of req once it's done.
+func (srv *Server) recordDone(req *http.Request) {
+	rec := recordOf(req)
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	if rec.status == 0 {
+		// Handlers returning without writing get the default of net/http
+		rec.status = http.StatusOK
+	}
+	status, reason := rec.status, rec.reason
+	rec.mu.Unlock()
+	up, down := atomic.LoadInt64(&rec.up), atomic.LoadInt64(&rec.down)
+	// Requests to the proxy itself, such as scrapes, aren't proxied
+	if req.Host != srv.Host {
+		srv.Metrics.request(req.Method, status, up, down, time.Since(rec.start))
+	}
+	endTrace(req, status, up, down, reason)
+	if srv.AccessLog.enabled() {
+		srv.AccessLog.log(req, rec)
+	}
+}
+
+// log writes the entry for req.
+func (l *AccessLog) log(req *http.Request, rec *accessRecord) {
+	rec.mu.Lock()
+	status, reason := rec.status, rec.reason
+	rec.mu.Unlock()
+	if a := activeOf(req); a != nil && a.closedReason() != "" {
+		reason = a.closedReason()
+	}
+	e := &accessEntry{
+		Time:      rec.start,
+		Client:    req.RemoteAddr,
+		Method:    req.Method,
+		Target:    target(req),
+		Proto:     req.Proto,
+		Status:    status,
+		BytesUp:   atomic.LoadInt64(&rec.up),
+		BytesDown: atomic.LoadInt64(&rec.down),
+		Duration:  time.Since(rec.start).Seconds(),
+		Reason:    reason,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	if host, _, err := net.SplitHostPort(e.Client); err == nil {
+		e.Client = host
+	}
+	if id := IdentityFromContext(req.Context()); id != nil {
+		e.User = id.User
+	}
+	if e.Reason == "" {
+		e.Reason = "done"
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return
+	}
+	var line []byte
+	switch l.format {
+	case LogCommon, LogCombined:
+		line = e.apache(l.format == LogCombined)
+	case LogJSON:
+		line, _ = json.Marshal(e)
+	default:
+		line = e.logfmt()
+	}
+	l.w.Write(append(line, '\n'))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (e *accessEntry) apache(combined bool) []byte {
+	bytes := "-"
+	if e.BytesDown > 0 {
+		bytes = strconv.FormatInt(e.BytesDown, 10)
+	}
+	s := fmt.Sprintf("%s - %s [%s] %q %d %s", dash(e.Client), dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strings.TrimSpace(e.Method+" "+e.Target+" "+e.Proto), e.Status, bytes)
+	if combined {
+		s += fmt.Sprintf(" %q %q", dash(e.Referer), dash(e.UserAgent))
+	}
+	return []byte(s)
+}
+
+func (e *accessEntry) logfmt() []byte {
+	var b strings.Builder
+	for _, kv := range []struct {
+		k, v string
+	}{
+		{"time", e.Time.Format(time.RFC3339Nano)},
+		{"client", e.Client},
+		{"user", e.User},
+		{"method", e.Method},
+		{"target", e.Target},
+		{"proto", e.Proto},
+		{"status", strconv.Itoa(e.Status)},
+		{"bytes_up", strconv.FormatInt(e.BytesUp, 10)},
+		{"bytes_down", strconv.FormatInt(e.BytesDown, 10)},
+		{"duration", strconv.FormatFloat(e.Duration, 'f', 3, 64)},
+		{"reason", e.Reason},
+		{"referer", e.Referer},
+		{"user_agent", e.UserAgent},
+	} {
+		if kv.v == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(kv.k + "=")
+		if strings.ContainsAny(kv.v, " \"=\\") || strings.IndexFunc(kv.v, func(r rune) bool { return r < ' ' }) >= 0 {
+			b.WriteString(strconv.Quote(kv.v))
+		} else {
+			b.WriteString(kv.v)
+		}
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer is a concurrency safe access log output.
+type logBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *logBuffer) Close() error {
+	return nil
+}
+
+func (b *logBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSuffix(b.b.String(), "\n"), "\n")
+}
+
+func TestAccessLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+		io.WriteString(w, "hello")
+	}))
+	defer ts.Close()
+	tlsTS := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer tlsTS.Close()
+
+	out := &logBuffer{}
+	al := &AccessLog{}
+	al.SetOutput(LogJSON, out)
+	proxy := httptest.NewServer(&Server{Host: "proxy", User: "user", Pass: "pass", AccessLog: al})
+	defer proxy.Close()
+
+	c := getProxiedClient(proxy)
+	c.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	resp, err := c.Post(ts.URL+"/path", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = c.Get(tlsTS.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Transport.(*http.Transport).CloseIdleConnections()
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Host = "other"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The tunnel is logged once it's closed
+	var lines []string
+	for i := 0; i < 50; i++ {
+		if lines = out.lines(); len(lines) == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(lines) != 3 {
+		t.Fatalf("got %q", lines)
+	}
+	var entries []accessEntry
+	for _, l := range lines {
+		var e accessEntry
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("%s: %v", l, err)
+		}
+		entries = append(entries, e)
+	}
+	byMethod := make(map[string]accessEntry)
+	for _, e := range entries {
+		byMethod[e.Method] = e
+	}
+	if e := byMethod["POST"]; e.User != "user" || e.Client != "127.0.0.1" || e.Target != ts.URL+"/path" ||
+		e.Status != 200 || e.BytesUp != 4 || e.BytesDown != 5 || e.Reason != "done" {
+		t.Errorf("POST: got %+v", e)
+	}
+	if e := byMethod["CONNECT"]; e.Target != strings.TrimPrefix(tlsTS.URL, "https://") || e.Status != 200 ||
+		e.BytesUp == 0 || e.BytesDown == 0 || e.Reason != "client closed" {
+		t.Errorf("CONNECT: got %+v", e)
+	}
+	if e := byMethod["GET"]; e.User != "" || e.Status != http.StatusProxyAuthRequired || e.Reason != "no credentials" {
+		t.Errorf("GET: got %+v", e)
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	e := &accessEntry{
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Client:    "192.0.2.1",
+		User:      "user",
+		Method:    "GET",
+		Target:    "http://example.com/",
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		BytesUp:   0,
+		BytesDown: 1234,
+		Duration:  0.5,
+		Reason:    "done",
+		UserAgent: "curl/7.0",
+	}
+	for _, tc := range []struct {
+		got, want string
+	}{
+		{string(e.apache(false)), `192.0.2.1 - user [02/Jan/2020:03:04:05 +0000] "GET http://example.com/ HTTP/1.1" 200 1234`},
+		{string(e.apache(true)), `192.0.2.1 - user [02/Jan/2020:03:04:05 +0000] "GET http://example.com/ HTTP/1.1" 200 1234 "-" "curl/7.0"`},
+		{string(e.logfmt()), `time=2020-01-02T03:04:05Z client=192.0.2.1 user=user method=GET target=http://example.com/ proto=HTTP/1.1 status=200 bytes_up=0 bytes_down=1234 duration=0.500 reason=done user_agent=curl/7.0`},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got  %s\nwant %s", tc.got, tc.want)
+		}
+	}
+	e.Reason = "client closed"
+	if got := string(e.logfmt()); !strings.Contains(got, ` reason="client closed" `) {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// host returns the destination host of c.
+func (c *Conn) host() string {
+	if u, err := url.Parse(c.Target); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(c.Target); err == nil {
+		return host
+	}
+	return c.Target
+}
+
+// isAdmin reports whether user may use the admin API.
+func (srv *Server) isAdmin(user string) bool {
+	if len(srv.Admins) == 0 {
+		return srv.User != "" && user == srv.User
+	}
+	for _, a := range srv.Admins {
+		if a == user {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAdmin authenticates req as one of the Admins, replying with an error
+// if it isn't. Anyone is if AllowAnonymous is set.
+func (srv *Server) checkAdmin(w http.ResponseWriter, req *http.Request) (*Identity, bool) {
+	id, err := srv.checkAuth(req, authorization)
+	if err != nil {
+		srv.unauthorized(w, req, err)
+		return nil, false
+	}
+	if id != nil && !srv.isAdmin(id.User) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+	return id, true
+}
+
+// serveConns is the admin API to requests and tunnels in flight:
+//
+//	GET /conns[?user=USER][&host=GLOB]   lists them as JSON, oldest first
+//	DELETE /conns/ID                     cuts one
+func (srv *Server) serveConns(w http.ResponseWriter, req *http.Request) {
+	id, ok := srv.checkAdmin(w, req)
+	if !ok {
+		return
+	}
+
+	if req.URL.Path == "/conns" {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		user, glob := req.URL.Query().Get("user"), strings.ToLower(req.URL.Query().Get("host"))
+		if _, err := path.Match(glob, ""); err != nil {
+			http.Error(w, "host: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		conns := []Conn{}
+		for _, c := range srv.Tracker.Conns() {
+			if user != "" && c.User != user {
+				continue
+			}
+			if ok, _ := path.Match(glob, strings.ToLower(c.host())); glob != "" && !ok {
+				continue
+			}
+			conns = append(conns, c)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(conns)
+		return
+	}
+
+	n, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/conns/"), 10, 64)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !srv.Tracker.Kill(n) {
+		http.NotFound(w, req)
+		return
+	}
+	by := "anonymous"
+	if id != nil {
+		by = id.User
+	}
+	log.Printf("Connection %d killed by %s", n, by)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// openTunnel connects to hostport through proxy as user, whose password is
+// the same.
+func openTunnel(t *testing.T, proxy *httptest.Server, user, hostport string) net.Conn {
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + user))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", hostport, hostport, auth)
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+	return conn
+}
+
+// adminRequest sends a request to h as user, whose password is the same.
+func adminRequest(h http.Handler, user, method, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://admin"+target, nil)
+	req.SetBasicAuth(user, user)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestConnsAPI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	srv := &Server{Host: "proxy", Credentials: credentialFunc(func(u, p string) bool { return u == p }), Tracker: &Tracker{}, Admins: []string{"admin"}}
+	proxy := httptest.NewServer(srv)
+	defer proxy.Close()
+	admin := NewAtomicServer(srv).AdminHandler()
+
+	alice := openTunnel(t, proxy, "alice", "127.0.0.1:"+port)
+	defer alice.Close()
+	bob := openTunnel(t, proxy, "bob", "localhost:"+port)
+	defer bob.Close()
+
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"alice", "bob"}},
+		{"?user=bob", []string{"bob"}},
+		{"?host=LOCAL*", []string{"bob"}},
+		{"?host=127.*&user=bob", nil},
+	} {
+		rr := adminRequest(admin, "admin", "GET", "/conns"+c.query)
+		var conns []Conn
+		if err := json.NewDecoder(rr.Body).Decode(&conns); err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		var users []string
+		for _, conn := range conns {
+			users = append(users, conn.User)
+		}
+		if fmt.Sprint(users) != fmt.Sprint(c.want) {
+			t.Errorf("%s: got %v want %v", c.query, users, c.want)
+		}
+	}
+
+	if rr := adminRequest(admin, "admin", "GET", "/conns?host=["); rr.Code != http.StatusBadRequest {
+		t.Errorf("bad glob: got %v", rr.Code)
+	}
+	if rr := adminRequest(admin, "admin", "GET", "/conns/1"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /conns/1: got %v", rr.Code)
+	}
+	if rr := adminRequest(admin, "admin", "DELETE", "/conns/99"); rr.Code != http.StatusNotFound {
+		t.Errorf("DELETE unknown: got %v", rr.Code)
+	}
+	if rr := adminRequest(admin, "bob", "DELETE", "/conns/1"); rr.Code != http.StatusForbidden {
+		t.Errorf("DELETE by bob: got %v", rr.Code)
+	}
+	if rr := adminRequest(admin, "bob", "GET", "/conns"); rr.Code != http.StatusForbidden {
+		t.Errorf("GET by bob: got %v", rr.Code)
+	}
+	if rr := adminRequest(admin, "admin", "DELETE", "/conns/1"); rr.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got %v", rr.Code)
+	}
+	alice.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := alice.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("killed tunnel: got %v want EOF", err)
+	}
+	for deadline := time.Now().Add(time.Second); srv.Tracker.Active() != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d active after kill", srv.Tracker.Active())
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://admin/conns", nil)
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: got %v", rr.Code)
+	}
+}
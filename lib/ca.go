@@ -0,0 +1,189 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// CA is a local certificate authority issuing server certificates, so that
+// clients trust javertd once rather than a new certificate every restart.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+const (
+	caCertName = "ca.pem"
+	caKeyName  = "ca-key.pem"
+)
+
+// LoadCA reads the CA certificate and key from ks, creating both if
+// neither exists. The key may be RSA, ECDSA or Ed25519.
+func LoadCA(ks *KeyStore) (*CA, error) {
+	certPath := ks.path(caCertName)
+	certPEM, err := ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(ks.path(caKeyName)); !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s exists without %s", ks.path(caKeyName), certPath)
+		}
+		return createCA(ks)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", certPath, err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s: not a CA certificate", certPath)
+	}
+	key, err := ks.Load(caKeyName)
+	if err != nil {
+		return nil, err
+	}
+	if !keyMatches(key, cert.PublicKey) {
+		return nil, fmt.Errorf("%s doesn't match %s", ks.path(caKeyName), certPath)
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func createCA(ks *KeyStore) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"javertd"}, CommonName: "javertd local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Save(caKeyName, key); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(ks.path(caCertName), CertToPem(der), 0644); err != nil {
+		return nil, err
+	}
+	log.Printf("Created local CA %s; install it in clients to trust javertd", ks.path(caCertName))
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// Issue returns a server certificate for names, which may be DNS names or
+// IP addresses, valid for validity.
+func (ca *CA) Issue(names []string, validity time.Duration) (*tls.Certificate, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no names to issue a certificate for")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if tmpl.NotAfter.After(ca.Cert.NotAfter) {
+		tmpl.NotAfter = ca.Cert.NotAfter
+	}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, n)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// LeafIssuer serves a certificate issued by CA, and issues a new one when
+// a third of its validity remains.
+type LeafIssuer struct {
+	CA       *CA
+	Names    []string
+	Validity time.Duration
+
+	mu   sync.Mutex
+	leaf *tls.Certificate
+}
+
+// GetCertificate is for tls.Config.GetCertificate.
+func (li *LeafIssuer) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if li.leaf != nil && time.Until(li.leaf.Leaf.NotAfter) > li.Validity/3 {
+		return li.leaf, nil
+	}
+	c, err := li.CA.Issue(li.Names, li.Validity)
+	if err != nil {
+		if li.leaf != nil {
+			log.Printf("Renewing certificate: %v", err)
+			return li.leaf, nil
+		}
+		return nil, err
+	}
+	log.Printf("Issued certificate for %v, valid until %v", li.Names, c.Leaf.NotAfter)
+	li.leaf = c
+	return c, nil
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "javertd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks := &KeyStore{Dir: filepath.Join(dir, "keys")}
+	certPath, keyPath := ks.path(caCertName), ks.path(caKeyName)
+
+	ca, err := LoadCA(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(keyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", fi, err)
+	}
+	// The CA persists
+	again, err := LoadCA(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Cert.Equal(ca.Cert) {
+		t.Errorf("LoadCA created a new CA")
+	}
+
+	c, err := again.Issue([]string{"proxy.example.com", "192.0.2.1", "::1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	for _, name := range []string{"proxy.example.com", "192.0.2.1", "::1"} {
+		if _, err := c.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	os.Remove(certPath)
+	if _, err := LoadCA(ks); err == nil {
+		t.Errorf("LoadCA without %s: got no error", certPath)
+	}
+}
+
+func TestLeafIssuer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "javertd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := LoadCA(&KeyStore{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	li := &LeafIssuer{CA: ca, Names: []string{"proxy"}, Validity: time.Hour}
+	c1, _ := li.GetCertificate(nil)
+	c2, _ := li.GetCertificate(nil)
+	if c1 != c2 {
+		t.Errorf("certificate renewed too early")
+	}
+	li.Validity = 3 * time.Hour // Only a third of it remains now
+	c3, err := li.GetCertificate(nil)
+	if err != nil || c3 == c1 {
+		t.Errorf("certificate not renewed: %v", err)
+	}
+}
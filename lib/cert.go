@@ -1,60 +1,77 @@
 package lib
 
 import (
-	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
-	"log"
-	"math/big"
-	"time"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 )
 
-func SelfSigned(hostname string) ([]byte, crypto.PrivateKey) {
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+func CertToPem(cert []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+}
+
+// LoadKeyPair is like tls.LoadX509KeyPair, but also reads encrypted keys.
+func LoadKeyPair(certFile, keyFile string, passphrase []byte) (*tls.Certificate, error) {
+	b, err := ioutil.ReadFile(certFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	now := time.Now()
-	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(now.UnixNano()),
-		Subject:      pkix.Name{Organization: []string{"Self-signed"}},
-		NotBefore:    now,
-		NotAfter:     now.Add(7 * 24 * time.Hour), // 1 day
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-	}
-	cert.DNSNames = append(cert.DNSNames, hostname)
-	publicKey := &privKey.PublicKey
-	derBytes, err := x509.CreateCertificate(rand.Reader, cert, cert, publicKey, privKey)
+	c := &tls.Certificate{}
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			c.Certificate = append(c.Certificate, block.Bytes)
+		}
+	}
+	if len(c.Certificate) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", certFile)
+	}
+	if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("%s: %v", certFile, err)
+	}
+	ks := &KeyStore{Dir: filepath.Dir(keyFile), Passphrase: passphrase}
+	key, err := ks.Load(filepath.Base(keyFile))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if !keyMatches(key, c.Leaf.PublicKey) {
+		return nil, fmt.Errorf("%s doesn't match %s", keyFile, certFile)
 	}
-	return derBytes, privKey
+	c.PrivateKey = key
+	return c, nil
 }
 
-func PrivToPem(priv crypto.PrivateKey) []byte {
-	var pemBlock *pem.Block
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		pemBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
-	case *ecdsa.PrivateKey:
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			log.Fatal(err)
-		}
-		pemBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
-	default:
-		return nil
+// LoadCertPool reads PEM encoded CA certificates from path.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	return pem.EncodeToMemory(pemBlock)
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
 }
 
-func CertToPem(cert []byte) []byte {
-	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+// certIdentity returns the name identifying a client certificate:
+// the subject CN, or else the first email, DNS or URI SAN.
+func certIdentity(c *x509.Certificate) string {
+	switch {
+	case c.Subject.CommonName != "":
+		return c.Subject.CommonName
+	case len(c.EmailAddresses) > 0:
+		return c.EmailAddresses[0]
+	case len(c.DNSNames) > 0:
+		return c.DNSNames[0]
+	case len(c.URIs) > 0:
+		return c.URIs[0].String()
+	}
+	return ""
 }
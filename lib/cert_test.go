@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func issueCert(t *testing.T, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := x509.ParseCertificate(der)
+	return c, key
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca, caKey := issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	client, clientKey := issueCert(t, &x509.Certificate{
+		EmailAddresses: []string{"alice@example.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	proxy := httptest.NewUnstartedServer(&Server{Host: "localhost", ClientCertAuth: true, User: "user", Pass: "pass"})
+	proxy.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	proxy.StartTLS()
+	defer proxy.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		certs []tls.Certificate
+		want  int
+	}{
+		{[]tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}}, http.StatusOK},
+		{nil, http.StatusProxyAuthRequired},
+	} {
+		pc, err := tls.Dial("tcp", proxy.Listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       c.certs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(pc, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", ts.URL, ts.Listener.Addr())
+		resp, err := http.ReadResponse(bufio.NewReader(pc), nil)
+		pc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.want {
+			t.Errorf("%d certs: got %v want %v", len(c.certs), resp.StatusCode, c.want)
+		}
+	}
+
+	if got := certIdentity(client); got != "alice@example.com" {
+		t.Errorf("got %q want %q", got, "alice@example.com")
+	}
+}
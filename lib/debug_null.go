@@ -9,18 +9,7 @@ import (
 type debugInfo struct {
 }
 
-func (*debugInfo) startRequest(req *http.Request) *http.Request {
-	return req
-}
-
-func (*debugInfo) updateRequest(*http.Request, int) {
-}
-
-func (*debugInfo) endRequest(*http.Request) {
-}
-
-func (*Server) status(w http.ResponseWriter, r *http.Request) {
-	http.NotFound(w, r)
+func (*debugInfo) logRequest(*http.Request) {
 }
 
 func (*debugInfo) logOutgoingRequest(*http.Request) {
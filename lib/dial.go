@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDeniedNets are loopback, private, link-local, shared, reserved and
+// multicast ranges, which an authenticated client shouldn't reach by default.
+var DefaultDeniedNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// ParseNets parses a list of CIDRs.
+func ParseNets(l []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(l))
+	for _, s := range l {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// forbiddenError is returned when a destination is refused.
+type forbiddenError struct {
+	msg string
+}
+
+func (e *forbiddenError) Error() string {
+	return e.msg
+}
+
+func isForbidden(err error) bool {
+	var fe *forbiddenError
+	return errors.As(err, &fe)
+}
+
+// dialErrorStatus maps an error connecting to the origin to a status code.
+func dialErrorStatus(err error) int {
+	var dnsErr *net.DNSError
+	var upErr *upstreamError
+	switch {
+	case isForbidden(err):
+		return http.StatusForbidden
+	case errors.As(err, &dnsErr), errors.As(err, &upErr):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func (srv *Server) checkPort(address string) error {
+	_, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := srv.RestrictedPorts[port]; ok {
+		return &forbiddenError{fmt.Sprintf("connection to port %d is restricted", port)}
+	}
+	return nil
+}
+
+// checkDestination checks req going to hostport against RestrictedPorts and
+// Policy before connecting. RestrictedPorts and DeniedNets are enforced
+// again by checkAddress for every dial, and cidr rules of the Policy by
+// checkDialed for dials with the returned request's context.
+func (srv *Server) checkDestination(req *http.Request, scheme, hostport string) (*http.Request, error) {
+	if err := srv.checkPort(hostport); err != nil {
+		return req, err
+	}
+	return srv.checkPolicy(req, scheme, hostport)
+}
+
+// parseIP is net.ParseIP, but also accepts IPv6 addresses with a zone, as
+// in fe80::1%eth0, dropping it.
+func parseIP(host string) net.IP {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// checkAddress is a net.Dialer Control function refusing RestrictedPorts
+// and DeniedNets. It sees the address actually being connected to, after
+// name resolution, so DNS rebinding can't bypass it.
+func (srv *Server) checkAddress(network, address string, _ syscall.RawConn) error {
+	if err := srv.checkPort(address); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(address)
+	ip := parseIP(host)
+	if ip == nil {
+		return &forbiddenError{fmt.Sprintf("connection to %q is not allowed", host)}
+	}
+	for _, n := range srv.DeniedNets {
+		if n.Contains(ip) {
+			return &forbiddenError{fmt.Sprintf("connection to %s is not allowed", host)}
+		}
+	}
+	return nil
+}
+
+// dial connects to an origin server on behalf of a client.
+func (srv *Server) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	timeout := srv.DialTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := srv.checkAddress(network, address, c); err != nil {
+				return err
+			}
+			return srv.checkDialed(ctx, address)
+		},
+	}
+	ctx, span := traceDial(ctx, "dial", address)
+	start := time.Now()
+	c, err := d.DialContext(ctx, network, address)
+	srv.Metrics.dialed("direct", start, err)
+	endSpan(span, err)
+	return c, err
+}
+
+// transport returns the RoundTripper for forwarded requests.
+func (srv *Server) transport() http.RoundTripper {
+	srv.transportOnce.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = srv.dial
+		srv.tr = t
+	})
+	return srv.tr
+}
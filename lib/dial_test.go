@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDeniedNets(t *testing.T) {
+	nets, err := ParseNets(DefaultDeniedNets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(&Server{Host: "proxy", User: "user", Pass: "pass", DeniedNets: nets})
+	defer proxy.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+	tlsTS := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer tlsTS.Close()
+
+	c := getProxiedClient(proxy)
+	for _, u := range []string{
+		ts.URL,
+		// The name is checked after resolution
+		strings.Replace(ts.URL, "127.0.0.1", "localhost", 1),
+	} {
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %v want %v", u, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	c.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if _, err := c.Get(tlsTS.URL); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Errorf("CONNECT: got %v want Forbidden", err)
+	}
+
+	srv := &Server{DeniedNets: nets}
+	for _, a := range []string{"[fe80::1%lo]:9", "[fe80::1%25lo]:9", "bogus:9"} {
+		if err := srv.checkAddress("tcp", a, nil); !isForbidden(err) {
+			t.Errorf("%s: got %v want forbidden", a, err)
+		}
+	}
+	if c, err := srv.dial(context.Background(), "tcp", "[fe80::1%lo]:9"); err == nil {
+		c.Close()
+		t.Errorf("dialed a zoned link-local address")
+	}
+}
+
+func TestRestrictedPorts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Errorf("request reached restricted port")
+	}))
+	defer ts.Close()
+	tlsTS := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Errorf("request reached restricted port")
+	}))
+	defer tlsTS.Close()
+
+	s := &Server{Host: "proxy", User: "user", Pass: "pass", RestrictedPorts: map[int]struct{}{}}
+	for _, u := range []string{ts.URL, tlsTS.URL} {
+		p, _ := strconv.Atoi(u[strings.LastIndex(u, ":")+1:])
+		s.RestrictedPorts[p] = struct{}{}
+	}
+	proxy := httptest.NewServer(s)
+	defer proxy.Close()
+
+	c := getProxiedClient(proxy)
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET: got %v want %v", resp.StatusCode, http.StatusForbidden)
+	}
+
+	c.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if _, err := c.Get(tlsTS.URL); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Errorf("CONNECT: got %v want Forbidden", err)
+	}
+}
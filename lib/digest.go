@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authentication schemes for Server.AuthSchemes.
+const (
+	SchemeBasic  = "Basic"
+	SchemeDigest = "Digest"
+	SchemeBearer = "Bearer"
+)
+
+const (
+	realm         = "proxy"
+	nonceLifetime = 5 * time.Minute
+)
+
+type nonceState struct {
+	nc     uint64
+	issued time.Time
+}
+
+// DigestAuth issues and validates nonces for RFC 7616 Digest authentication.
+// Nonces are self-authenticating (HMAC over timestamp and random bytes), so
+// only nonces actually used by clients are remembered, to reject replays.
+// One DigestAuth is shared by Servers replacing each other on reload, so
+// that the nonces of clients stay valid.
+type DigestAuth struct {
+	once sync.Once
+	key  []byte
+
+	mu        sync.Mutex
+	seen      map[string]nonceState
+	lastSweep time.Time
+}
+
+func (srv *Server) digestAuth() *DigestAuth {
+	if srv.Digest != nil {
+		return srv.Digest
+	}
+	return &srv.digest
+}
+
+func (d *DigestAuth) init() {
+	d.once.Do(func() {
+		d.key = make([]byte, 32)
+		if _, err := rand.Read(d.key); err != nil {
+			panic(err)
+		}
+		d.seen = make(map[string]nonceState)
+	})
+}
+
+func (d *DigestAuth) mac(b []byte) []byte {
+	m := hmac.New(sha256.New, d.key)
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+func (d *DigestAuth) newNonce() string {
+	d.init()
+	b := make([]byte, 16, 16+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	rand.Read(b[8:16])
+	return base64.RawURLEncoding.EncodeToString(append(b, d.mac(b)...))
+}
+
+// useNonce records nc for nonce, rejecting forged, expired or replayed ones.
+func (d *DigestAuth) useNonce(nonce string, nc uint64) error {
+	d.init()
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 16+sha256.Size || !hmac.Equal(b[16:], d.mac(b[:16])) {
+		return errBadCredentials
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	now := time.Now()
+	if now.Sub(issued) > nonceLifetime {
+		return errStaleNonce
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastSweep) > nonceLifetime {
+		for k, v := range d.seen {
+			if now.Sub(v.issued) > nonceLifetime {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	if nc <= d.seen[nonce].nc {
+		return errBadCredentials
+	}
+	d.seen[nonce] = nonceState{nc: nc, issued: issued}
+	return nil
+}
+
+func (d *DigestAuth) challenges(stale bool) []string {
+	nonce := d.newNonce()
+	var l []string
+	for _, algo := range []string{"SHA-256", "MD5"} {
+		c := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s"`, realm, algo, nonce)
+		if stale {
+			c += ", stale=true"
+		}
+		l = append(l, c)
+	}
+	return l
+}
+
+// parseDigestParams parses the comma separated auth-param list of a
+// Digest Authorization header.
+func parseDigestParams(s string) map[string]string {
+	m := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return m
+		}
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			return m
+		}
+		k := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+		var v string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i = 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			v = b.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			i = strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+			v = strings.TrimSpace(s[:i])
+			s = s[i:]
+		}
+		m[k] = v
+	}
+}
+
+func digestHash(algo string) (func() hash.Hash, bool) {
+	switch strings.TrimSuffix(strings.ToUpper(algo), "-SESS") {
+	case "", "MD5":
+		return md5.New, true
+	case "SHA-256":
+		return sha256.New, true
+	}
+	return nil, false
+}
+
+func hexHash(h func() hash.Hash, parts ...string) string {
+	d := h()
+	d.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// checkDigest verifies Digest credentials against srv.User and srv.Pass.
+// Hashed passwords cannot be used with Digest.
+func (srv *Server) checkDigest(r *http.Request, params string) (string, error) {
+	p := parseDigestParams(params)
+	if srv.Pass == "" || srv.Credentials != nil {
+		return "", errBadCredentials
+	}
+	h, ok := digestHash(p["algorithm"])
+	if !ok || p["qop"] != "auth" || p["realm"] != realm || p["uri"] != r.RequestURI {
+		return "", errBadCredentials
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 64)
+	if err != nil || p["cnonce"] == "" {
+		return "", errBadCredentials
+	}
+
+	ha1 := hexHash(h, srv.User, realm, srv.Pass)
+	if strings.HasSuffix(strings.ToUpper(p["algorithm"]), "-SESS") {
+		ha1 = hexHash(h, ha1, p["nonce"], p["cnonce"])
+	}
+	ha2 := hexHash(h, r.Method, p["uri"])
+	want := hexHash(h, ha1, p["nonce"], p["nc"], p["cnonce"], p["qop"], ha2)
+	userOK := constantTimeEqual(p["username"], srv.User)
+	if !constantTimeEqual(p["response"], want) || !userOK {
+		return "", errBadCredentials
+	}
+	if err := srv.digestAuth().useNonce(p["nonce"], nc); err != nil {
+		return "", err
+	}
+	return p["username"], nil
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func digestChallenge(t *testing.T, s *Server, algo string) string {
+	r := httptest.NewRequest("GET", "http://other.com/", nil)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, r)
+	if rr.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("got %v want %v", rr.Code, http.StatusProxyAuthRequired)
+	}
+	for _, c := range rr.Header()["Proxy-Authenticate"] {
+		if strings.HasPrefix(c, SchemeDigest+" ") && strings.Contains(c, "algorithm="+algo+",") {
+			return parseDigestParams(c[len(SchemeDigest)+1:])["nonce"]
+		}
+	}
+	t.Fatalf("no %s challenge in %v", algo, rr.Header()["Proxy-Authenticate"])
+	return ""
+}
+
+func digestRequest(h func() hash.Hash, algo, user, pass, nonce, nc string) *http.Request {
+	const uri = "http://other.com/"
+	r := httptest.NewRequest("GET", uri, nil)
+	ha1 := hexHash(h, user, realm, pass)
+	ha2 := hexHash(h, "GET", uri)
+	resp := hexHash(h, ha1, nonce, nc, "cn", "auth", ha2)
+	r.Header.Set(proxyAuthorization, fmt.Sprintf(
+		`Digest username="%s", realm="proxy", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="cn", response="%s"`,
+		user, nonce, uri, algo, nc, resp))
+	return r
+}
+
+func TestDigest(t *testing.T) {
+	s := &Server{Host: "localhost", User: "user", Pass: "pass", AuthSchemes: []string{SchemeDigest}}
+	for _, c := range []struct {
+		algo string
+		h    func() hash.Hash
+	}{
+		{"SHA-256", sha256.New},
+		{"MD5", md5.New},
+	} {
+		nonce := digestChallenge(t, s, c.algo)
+		if _, err := s.checkAuth(digestRequest(c.h, c.algo, "user", "pass", nonce, "00000001"), proxyAuthorization); err != nil {
+			t.Errorf("%s: %v", c.algo, err)
+		}
+		if _, err := s.checkAuth(digestRequest(c.h, c.algo, "user", "pass", nonce, "00000001"), proxyAuthorization); err == nil {
+			t.Errorf("%s: replayed nc accepted", c.algo)
+		}
+		if _, err := s.checkAuth(digestRequest(c.h, c.algo, "user", "pass", nonce, "00000002"), proxyAuthorization); err != nil {
+			t.Errorf("%s: next nc: %v", c.algo, err)
+		}
+		if _, err := s.checkAuth(digestRequest(c.h, c.algo, "user", "wrong", nonce, "00000003"), proxyAuthorization); err == nil {
+			t.Errorf("%s: wrong password accepted", c.algo)
+		}
+		if _, err := s.checkAuth(digestRequest(c.h, c.algo, "user", "pass", "forged", "00000001"), proxyAuthorization); err == nil {
+			t.Errorf("%s: forged nonce accepted", c.algo)
+		}
+	}
+
+	// Basic is not enabled
+	r := httptest.NewRequest("GET", "http://other.com/", nil)
+	r.SetBasicAuth("user", "pass")
+	r.Header.Set(proxyAuthorization, r.Header.Get(authorization))
+	if _, err := s.checkAuth(r, proxyAuthorization); err == nil {
+		t.Errorf("Basic accepted when only Digest is enabled")
+	}
+}
+
+func TestDigestReload(t *testing.T) {
+	var d DigestAuth
+	old := &Server{Host: "localhost", User: "user", Pass: "pass", AuthSchemes: []string{SchemeDigest}, Digest: &d}
+	nonce := digestChallenge(t, old, "SHA-256")
+	s := &Server{Host: "localhost", User: "user", Pass: "pass", AuthSchemes: []string{SchemeDigest}, Digest: &d}
+	if _, err := s.checkAuth(digestRequest(sha256.New, "SHA-256", "user", "pass", nonce, "00000001"), proxyAuthorization); err != nil {
+		t.Errorf("nonce of the replaced Server: %v", err)
+	}
+}
+
+func TestParseDigestParams(t *testing.T) {
+	got := parseDigestParams(`username="Mufasa", realm="a,b \"c\"", nc=00000001 ,qop=auth`)
+	want := map[string]string{"username": "Mufasa", "realm": `a,b "c"`, "nc": "00000001", "qop": "auth"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
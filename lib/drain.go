@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracker tracks requests and tunnels in flight, to show them on the status
+// page and to drain them on shutdown. One Tracker is shared by Servers
+// replacing each other on reload. A nil Tracker tracks nothing.
+type Tracker struct {
+	mu     sync.Mutex
+	active map[*activeRequest]struct{}
+	nextID uint64
+}
+
+// activeRequest is a request being served. Closing it aborts the request,
+// or severs its tunnel.
+type activeRequest struct {
+	id                    uint64
+	start                 time.Time
+	client, method, proto string
+	target                string
+	rec                   *accessRecord // For bytes relayed, if recorded
+
+	mu         sync.Mutex
+	user       string
+	upClosed   bool
+	downClosed bool
+	closers    []func()
+	closed     string // Why it was cut, if it was
+}
+
+const activeKey contextKey = 1
+
+func (a *activeRequest) onClose(f func()) {
+	a.mu.Lock()
+	closed := a.closed != ""
+	if !closed {
+		a.closers = append(a.closers, f)
+	}
+	a.mu.Unlock()
+	if closed {
+		f()
+	}
+}
+
+// closedReason returns why a was cut, or "" if it wasn't.
+func (a *activeRequest) closedReason() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closed
+}
+
+func (a *activeRequest) close(reason string) {
+	a.mu.Lock()
+	closers := a.closers
+	a.closers = nil
+	if a.closed == "" {
+		a.closed = reason
+	}
+	a.mu.Unlock()
+	for _, f := range closers {
+		f()
+	}
+}
+
+// start tracks req until the returned function is called. The request's
+// context is canceled when it's cut.
+func (t *Tracker) start(req *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(req.Context())
+	a := &activeRequest{closers: []func(){cancel}}
+	req = req.WithContext(context.WithValue(ctx, activeKey, a))
+	if t == nil {
+		return req, cancel
+	}
+	a.start = time.Now()
+	a.client, a.method, a.proto, a.target = req.RemoteAddr, req.Method, req.Proto, target(req)
+	a.rec = recordOf(req)
+	if id := IdentityFromContext(req.Context()); id != nil {
+		a.user = id.User
+	}
+	t.mu.Lock()
+	if t.active == nil {
+		t.active = make(map[*activeRequest]struct{})
+	}
+	t.nextID++
+	a.id = t.nextID
+	t.active[a] = struct{}{}
+	t.mu.Unlock()
+	return req, func() {
+		t.mu.Lock()
+		delete(t.active, a)
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// onClose arranges for f to be called if req is cut, such as to close the
+// connections of a hijacked tunnel.
+func onClose(req *http.Request, f func()) {
+	if a, ok := req.Context().Value(activeKey).(*activeRequest); ok {
+		a.onClose(f)
+	}
+}
+
+func activeOf(req *http.Request) *activeRequest {
+	a, _ := req.Context().Value(activeKey).(*activeRequest)
+	return a
+}
+
+// updateRequest records a tunnel of req being closed in the direction of
+// ev, eventUpClosed or eventDownClosed.
+func updateRequest(req *http.Request, ev int) {
+	a := activeOf(req)
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	switch ev {
+	case eventUpClosed:
+		a.upClosed = true
+	case eventDownClosed:
+		a.downClosed = true
+	}
+	a.mu.Unlock()
+}
+
+// Conn describes a request or tunnel in flight.
+type Conn struct {
+	ID         uint64    `json:"id"`
+	Client     string    `json:"client"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Target     string    `json:"target"`
+	Proto      string    `json:"proto,omitempty"`
+	Start      time.Time `json:"start"`
+	Age        float64   `json:"age"`     // Seconds
+	BytesUp    int64     `json:"bytesUp"` // From the client
+	BytesDown  int64     `json:"bytesDown"`
+	UpClosed   bool      `json:"upClosed"` // The client has stopped sending
+	DownClosed bool      `json:"downClosed"`
+}
+
+// Conns returns what's in flight, oldest first.
+func (t *Tracker) Conns() []Conn {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	active := make([]*activeRequest, 0, len(t.active))
+	for a := range t.active {
+		active = append(active, a)
+	}
+	t.mu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].id < active[j].id })
+
+	now := time.Now()
+	conns := make([]Conn, len(active))
+	for i, a := range active {
+		c := Conn{
+			ID:     a.id,
+			Client: a.client,
+			Method: a.method,
+			Target: a.target,
+			Proto:  a.proto,
+			Start:  a.start,
+			Age:    now.Sub(a.start).Seconds(),
+		}
+		if host, _, err := net.SplitHostPort(c.Client); err == nil {
+			c.Client = host
+		}
+		if a.rec != nil {
+			c.BytesUp = atomic.LoadInt64(&a.rec.up)
+			c.BytesDown = atomic.LoadInt64(&a.rec.down)
+		}
+		a.mu.Lock()
+		c.User, c.UpClosed, c.DownClosed = a.user, a.upClosed, a.downClosed
+		a.mu.Unlock()
+		conns[i] = c
+	}
+	return conns
+}
+
+// Kill cuts the request or tunnel with id, and reports whether it was in
+// flight.
+func (t *Tracker) Kill(id uint64) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	var found *activeRequest
+	for a := range t.active {
+		if a.id == id {
+			found = a
+			break
+		}
+	}
+	t.mu.Unlock()
+	if found == nil {
+		return false
+	}
+	found.close("killed")
+	return true
+}
+
+// Active returns the number of requests and tunnels in flight.
+func (t *Tracker) Active() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.active)
+}
+
+// Drain waits until nothing is in flight or ctx is done, whichever comes
+// first. Then it cuts whatever remains and returns how many were cut.
+func (t *Tracker) Drain(ctx context.Context) int {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for t.Active() > 0 {
+		select {
+		case <-ctx.Done():
+			t.mu.Lock()
+			var cut []*activeRequest
+			for a := range t.active {
+				cut = append(cut, a)
+			}
+			t.mu.Unlock()
+			for _, a := range cut {
+				a.close("shutdown")
+			}
+			return len(cut)
+		case <-tick.C:
+		}
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	tracker := &Tracker{}
+	proxy := httptest.NewServer(&Server{Host: "localhost", User: "user", Pass: "pass", Tracker: tracker})
+	defer proxy.Close()
+	echo := createEchoServer()
+	defer echo.Close()
+
+	connect := func() (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", echo.Addr(), echo.Addr())
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT: %v %v", resp, err)
+		}
+		return c, br
+	}
+
+	// A tunnel closed by the client within the grace period isn't cut
+	closing, _ := connect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drained := make(chan int)
+	go func() { drained <- tracker.Drain(ctx) }()
+	closing.Close()
+	if n := <-drained; n != 0 {
+		t.Errorf("Drain: got %d cut want 0", n)
+	}
+
+	// One still open when the grace period ends is
+	c, br := connect()
+	defer c.Close()
+	if n := tracker.Active(); n != 1 {
+		t.Errorf("Active: got %d want 1", n)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if n := tracker.Drain(ctx); n != 1 {
+		t.Errorf("Drain: got %d cut want 1", n)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(br); err != nil {
+		t.Errorf("tunnel wasn't closed: %v", err)
+	}
+}
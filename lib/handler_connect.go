@@ -24,18 +24,29 @@ func (fw flushWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
-func hijackedHandler(remote *net.TCPConn, local net.Conn, bufrw *bufio.ReadWriter) {
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// hijackedHandler copies between remote and the hijacked connection of
+// req until both directions are closed.
+func hijackedHandler(req *http.Request, remote net.Conn, local net.Conn, bufrw *bufio.ReadWriter) {
 	defer local.Close()
 	bufrw.Flush()
 	complete := make(chan bool)
 	go func() {
-		io.Copy(remote, bufrw)
-		remote.CloseWrite()
+		io.Copy(countBytes(req, remote, true), bufrw)
+		logReason(req, "client closed")
+		updateRequest(req, eventUpClosed)
+		if cw, ok := remote.(closeWriter); ok {
+			cw.CloseWrite()
+		}
 		complete <- true
 	}()
 	go func() {
-		io.Copy(bufrw, remote)
-		bufrw.Flush()
+		io.Copy(countBytes(req, local, false), remote)
+		logReason(req, "origin closed")
+		updateRequest(req, eventDownClosed)
 		complete <- true
 	}()
 	<-complete
@@ -43,19 +54,11 @@ func hijackedHandler(remote *net.TCPConn, local net.Conn, bufrw *bufio.ReadWrite
 }
 
 func (srv *Server) connectHandler(w http.ResponseWriter, req *http.Request) {
-	addr, err := net.ResolveTCPAddr("tcp", req.Host)
-	if err != nil {
-		http.Error(w, "DNS Resolution Failed: "+req.Host, http.StatusBadGateway)
-		return
-	}
-	if _, ok := srv.RestrictedPorts[addr.Port]; ok {
-		http.Error(w, "Connection to port %d is restricted", http.StatusForbidden)
-		return
-	}
-	conn, err := net.DialTCP("tcp", nil, addr)
+	conn, err := srv.dialDestination(req, req.Host)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logReason(req, err.Error())
+		http.Error(w, err.Error(), dialErrorStatus(err))
 		return
 	}
 	defer conn.Close()
@@ -73,7 +76,14 @@ func (srv *Server) connectHandler(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		hijackedHandler(conn, local, bufrw)
+		onClose(req, func() {
+			local.Close()
+			conn.Close()
+		})
+		defer srv.Metrics.tunnel("HTTP/1.1")()
+		_, span := startSpan(req.Context(), "tunnel")
+		defer span.End()
+		hijackedHandler(req, conn, local, bufrw)
 	} else {
 		// HTTP/2.x
 		w.Header()["Content-Type"] = nil
@@ -85,21 +95,30 @@ func (srv *Server) connectHandler(w http.ResponseWriter, req *http.Request) {
 			panic("no flusher")
 		}
 		log.Printf("Connected: %s", req.Host)
+		defer srv.Metrics.tunnel("HTTP/2")()
+		_, span := startSpan(req.Context(), "tunnel")
+		defer span.End()
 		complete := make(chan error)
 		defer req.Body.Close()
+		onClose(req, func() {
+			conn.Close()
+			req.Body.Close()
+		})
 		go func() {
 			// src to dest
 			_, err := io.Copy(conn, req.Body)
+			logReason(req, "client closed")
 
-			srv.updateRequest(req, eventUpClosed)
+			updateRequest(req, eventUpClosed)
 			complete <- err
 		}()
 		go func() {
 			// dest to src
 			_, err := io.Copy(flushWriter{w}, conn)
+			logReason(req, "origin closed")
 			req.Body.Close()
 
-			srv.updateRequest(req, eventDownClosed)
+			updateRequest(req, eventDownClosed)
 			complete <- err
 		}()
 		err1 := <-complete
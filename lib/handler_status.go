@@ -1,8 +1,7 @@
-// +build debug
-
 package lib
 
 import (
+	"encoding/json"
 	"html/template"
 	"log"
 	"net/http"
@@ -11,26 +10,37 @@ import (
 
 var templateHtml = `
 <html>
-<head>Statusz</head>
+<head><title>Statusz</title></head>
  <body>
   <p>Build with {{.Version}}</p>
+  <p>{{ len .Active }} active</p>
   <table>
    <tr>
-    <td>ReqID</td>
-    <td>Timestamp</td>
+    <td>ID</td>
+    <td>Client</td>
+    <td>User</td>
     <td>Method</td>
+    <td>Target</td>
+    <td>Proto</td>
+    <td>Age</td>
+    <td>BytesUp</td>
+    <td>BytesDown</td>
     <td>UpClosed</td>
     <td>DownClosed</td>
-    <td>URL</td>
    </tr>
-   {{ range $id, $req := .Active }}
+   {{ range .Active }}
    <tr>
-    <td>{{ $id }}</td>
-    <td>{{ $req.Timestamp.String }}</td>
-    <td>{{ $req.Method }}</td>
-    <td>{{ $req.UpClosed }}</td>
-    <td>{{ $req.DownClosed }}</td>
-    <td>{{ $req.URL.String }}</td>
+    <td>{{ .ID }}</td>
+    <td>{{ .Client }}</td>
+    <td>{{ .User }}</td>
+    <td>{{ .Method }}</td>
+    <td>{{ .Target }}</td>
+    <td>{{ .Proto }}</td>
+    <td>{{ printf "%.1fs" .Age }}</td>
+    <td>{{ .BytesUp }}</td>
+    <td>{{ .BytesDown }}</td>
+    <td>{{ .UpClosed }}</td>
+    <td>{{ .DownClosed }}</td>
    </tr>
    {{ end }}
   </table>
@@ -40,27 +50,31 @@ var templateHtml = `
 var t = template.Must(template.New("n").Parse(templateHtml))
 
 type te struct {
-	Version string
-	Active  map[uint64]sReq
-}
-
-func unauthorized(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("WWW-Authenticate", `Basic realm="proxy"`)
-	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	Version string `json:"version"`
+	Active  []Conn `json:"active"`
 }
 
+// status shows the requests and tunnels in flight to admins, as JSON with
+// ?format=json.
 func (srv *Server) status(w http.ResponseWriter, req *http.Request) {
-	if !srv.checkAuth(req, authorization) {
-		unauthorized(w, req)
+	if _, ok := srv.checkAdmin(w, req); !ok {
 		return
 	}
 
-	srv.mu.Lock()
-	err := t.Execute(w, &te{
+	s := &te{
 		Version: runtime.Version(),
-		Active:  srv.activeReqs,
-	})
-	srv.mu.Unlock()
+		Active:  srv.Tracker.Conns(),
+	}
+	if s.Active == nil {
+		s.Active = []Conn{}
+	}
+	var err error
+	if req.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(s)
+	} else {
+		err = t.Execute(w, s)
+	}
 	if err != nil {
 		log.Printf("error: %v", err)
 	}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getStatus(t *testing.T, h http.Handler) []Conn {
+	req := httptest.NewRequest("GET", "http://admin/?format=json", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v", rr.Code)
+	}
+	var s struct {
+		Active []Conn
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	return s.Active
+}
+
+func TestStatus(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	release := make(chan bool)
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		<-release
+		c.Close()
+	}()
+	defer close(release)
+
+	srv := &Server{Host: "proxy", User: "user", Pass: "pass", Tracker: &Tracker{}}
+	proxy := httptest.NewServer(srv)
+	defer proxy.Close()
+	admin := NewAtomicServer(srv).AdminHandler()
+	if conns := getStatus(t, admin); len(conns) != 0 {
+		t.Errorf("got %+v before connecting", conns)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := echo.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", host, host)
+	br := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+	io.WriteString(conn, "hello")
+	if _, err := io.ReadFull(br, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// Half-close the tunnel; the origin keeps its side open.
+	conn.(*net.TCPConn).CloseWrite()
+	var c Conn
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conns := getStatus(t, admin)
+		if len(conns) != 1 {
+			t.Fatalf("got %+v want a tunnel", conns)
+		}
+		if c = conns[0]; c.UpClosed || time.Now().After(deadline) {
+			break
+		}
+	}
+	if c.User != "user" || c.Method != "CONNECT" || c.Target != host || c.BytesUp != 5 || c.BytesDown != 5 || !c.UpClosed || c.DownClosed {
+		t.Errorf("got %+v", c)
+	}
+
+	req := httptest.NewRequest("GET", "http://admin/", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	admin.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), "<td>"+host+"</td>") {
+		t.Errorf("HTML doesn't show the tunnel:\n%s", rr.Body.String())
+	}
+
+	// Proxy listeners don't serve it
+	req = httptest.NewRequest("GET", "http://proxy/", nil)
+	req.SetBasicAuth("user", "pass")
+	rr = httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status on the proxy host: got %v", rr.Code)
+	}
+}
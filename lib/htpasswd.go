@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Credentials verifies a user name and password pair.
+type Credentials interface {
+	Check(user, pass string) bool
+}
+
+// Htpasswd is a Credentials backed by an Apache htpasswd file.
+// Entries may use bcrypt ($2y$, $2a$, $2b$), {SHA}, or any format
+// produced by HashPassword.
+type Htpasswd struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string]string
+}
+
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload re-reads the file. On error the previous entries are kept.
+func (h *Htpasswd) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return fmt.Errorf("%s:%d: malformed entry", h.path, n)
+		}
+		if !SupportedHash(pair[1]) {
+			return fmt.Errorf("%s:%d: unsupported hash for user %q", h.path, n, pair[0])
+		}
+		users[pair[0]] = pair[1]
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+// dummyHash is checked for unknown users, so that they take as long as
+// known ones and can't be told apart.
+const dummyHash = "$2a$10$4NslfjQOuv/mFDereg1XoOSW/3f4CqdJhA1lyceziLzLSjOECoa42"
+
+func (h *Htpasswd) Check(user, pass string) bool {
+	h.mu.RLock()
+	hash, ok := h.users[user]
+	h.mu.RUnlock()
+	if !ok {
+		checkHash(dummyHash, pass)
+		return false
+	}
+	return checkHash(hash, pass)
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, dir, content string) string {
+	p := filepath.Join(dir, "htpasswd")
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHtpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, _ := bcrypt.GenerateFromPassword([]byte("alicepw"), bcrypt.MinCost)
+	p := writeHtpasswd(t, dir, "# comment\n"+
+		"alice:"+string(b)+"\n"+
+		// htpasswd -bs bob bobpw
+		"bob:{SHA}KXV5lfOmXj1HOy0eE1tRGdIyUHw=\n")
+	h, err := LoadHtpasswd(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "alicepw", true},
+		{"alice", "bobpw", false},
+		{"bob", "bobpw", true},
+		{"bob", "", false},
+		{"carol", "alicepw", false},
+	} {
+		if got := h.Check(c.user, c.pass); got != c.want {
+			t.Errorf("Check(%q, %q) = %v want %v", c.user, c.pass, got, c.want)
+		}
+	}
+
+	// Revoke bob
+	writeHtpasswd(t, dir, "alice:"+string(b)+"\n")
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Check("bob", "bobpw") {
+		t.Errorf("bob is still accepted after reload")
+	}
+
+	// A broken file keeps the previous entries
+	writeHtpasswd(t, dir, "alice:$apr1$xxxxxxxx$yyyyyyyyyyyyyyyyyyyyyy\n")
+	if err := h.Reload(); err == nil {
+		t.Errorf("Reload accepted unsupported hash")
+	}
+	if !h.Check("alice", "alicepw") {
+		t.Errorf("alice is rejected after failed reload")
+	}
+	// Unknown users are checked against a real hash, to take as long
+	if !SupportedHash(dummyHash) || !checkHash(dummyHash, "dummy password of no user") {
+		t.Errorf("dummyHash isn't a valid hash")
+	}
+}
+
+func TestHtpasswdProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h, err := LoadHtpasswd(writeHtpasswd(t, dir, "bob:{SHA}KXV5lfOmXj1HOy0eE1tRGdIyUHw=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(&Server{Host: "localhost", Credentials: h})
+	defer proxy.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		pass string
+		want int
+	}{
+		{"bobpw", http.StatusOK},
+		{"wrong", http.StatusProxyAuthRequired},
+	} {
+		u, _ := url.Parse(proxy.URL)
+		u.User = url.UserPassword("bob", c.pass)
+		cl := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+		resp, err := cl.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("password %q: got %v want %v", c.pass, resp.StatusCode, c.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenVerifier verifies a bearer token and returns its claims.
+type TokenVerifier interface {
+	Verify(token string) (map[string]interface{}, error)
+}
+
+// JWTVerifier verifies JWTs signed by keys in a local JWKS file.
+// RS*, PS*, ES* and EdDSA are accepted; "none" and HMAC are not.
+type JWTVerifier struct {
+	Audience string            // Required "aud", if set
+	Issuer   string            // Required "iss", if set
+	Claims   map[string]string // Required claim values; arrays must contain the value
+	Leeway   time.Duration
+
+	path string
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+func LoadJWKS(path string) (*JWTVerifier, error) {
+	v := &JWTVerifier{path: path, Leeway: time.Minute}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Reload re-reads the JWKS file. On error the previous keys are kept.
+func (v *JWTVerifier) Reload() error {
+	b, err := ioutil.ReadFile(v.path)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return fmt.Errorf("%s: %v", v.path, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("%s: key %q: %v", v.path, k.Kid, err)
+		}
+		keys[k.Kid] = pub
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := b64url(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func b64url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var c elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			c = elliptic.P256()
+		case "P-384":
+			c = elliptic.P384()
+		case "P-521":
+			c = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !c.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: c, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64url(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func (v *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (v *JWTVerifier) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, err
+	}
+	key, err := v.key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := b64url(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := b64url(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var family string
+	var h crypto.Hash
+	if len(alg) == 5 {
+		family = alg[:2]
+	}
+	switch strings.TrimPrefix(alg, family) {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if h == 0 {
+			break
+		}
+		d := h.New()
+		d.Write(signed)
+		switch family {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, h, d.Sum(nil), sig)
+		case "PS":
+			return rsa.VerifyPSS(k, h, d.Sum(nil), sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if h == 0 || family != "ES" || len(sig) != 2*size {
+			break
+		}
+		d := h.New()
+		d.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, d.Sum(nil), r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q is not allowed for this key", alg)
+}
+
+func numericDate(claims map[string]interface{}, name string) (time.Time, bool) {
+	f, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+func claimContains(c interface{}, want string) bool {
+	switch c := c.(type) {
+	case string:
+		return c == want
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *JWTVerifier) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := numericDate(claims, "exp")
+	if !ok {
+		return errors.New("missing exp")
+	}
+	if now.After(exp.Add(v.Leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims, "nbf"); ok && now.Add(v.Leeway).Before(nbf) {
+		return errors.New("token not yet valid")
+	}
+	if v.Audience != "" && !claimContains(claims["aud"], v.Audience) {
+		return errors.New("bad aud")
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return errors.New("bad iss")
+	}
+	for k, want := range v.Claims {
+		if !claimContains(claims[k], want) {
+			return fmt.Errorf("bad %s", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var rawURL = base64.RawURLEncoding
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := rawURL.EncodeToString(h) + "." + rawURL.EncodeToString(c)
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		d := sha256.Sum256([]byte(signed))
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, d[:])
+	case *ecdsa.PrivateKey:
+		d := sha256.Sum256([]byte(signed))
+		r, s, _ := ecdsa.Sign(rand.Reader, k, d[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return signed + "." + rawURL.EncodeToString(sig)
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": rawURL.EncodeToString(rsaKey.N.Bytes()),
+			"e": rawURL.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": rawURL.EncodeToString(ecKey.X.Bytes()), "y": rawURL.EncodeToString(ecKey.Y.Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": rawURL.EncodeToString(edKey.Public().(ed25519.PublicKey))},
+	}})
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "jwks.json")
+	ioutil.WriteFile(p, jwks, 0600)
+
+	v, err := LoadJWKS(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Audience = "proxy"
+	v.Claims = map[string]string{"groups": "ci"}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	good := map[string]interface{}{"sub": "runner-1", "aud": []string{"proxy", "other"}, "exp": exp, "groups": []string{"ci"}}
+	for _, c := range []struct {
+		name   string
+		token  string
+		wantOK bool
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", rsaKey, good), true},
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, good), true},
+		{"EdDSA", signJWT(t, "EdDSA", "ed", edKey, good), true},
+		{"wrong kid", signJWT(t, "RS256", "ec", rsaKey, good), false},
+		{"alg confusion", signJWT(t, "ES256", "rsa", ecKey, good), false},
+		{"expired", signJWT(t, "EdDSA", "ed", edKey, map[string]interface{}{
+			"sub": "runner-1", "aud": "proxy", "exp": time.Now().Add(-time.Hour).Unix(), "groups": "ci"}), false},
+		{"no exp", signJWT(t, "EdDSA", "ed", edKey, map[string]interface{}{
+			"sub": "runner-1", "aud": "proxy", "groups": "ci"}), false},
+		{"bad aud", signJWT(t, "EdDSA", "ed", edKey, map[string]interface{}{
+			"sub": "runner-1", "aud": "web", "exp": exp, "groups": "ci"}), false},
+		{"missing claim", signJWT(t, "EdDSA", "ed", edKey, map[string]interface{}{
+			"sub": "runner-1", "aud": "proxy", "exp": exp}), false},
+	} {
+		s := &Server{Host: "localhost", Tokens: v}
+		r := httptest.NewRequest("GET", "http://other.com/", nil)
+		r.Header.Set(proxyAuthorization, "Bearer "+c.token)
+		id, err := s.checkAuth(r, proxyAuthorization)
+		if (err == nil) != c.wantOK {
+			t.Errorf("%s: got %v want ok=%v", c.name, err, c.wantOK)
+			continue
+		}
+		if err == nil && id.User != "runner-1" {
+			t.Errorf("%s: got user %q want %q", c.name, id.User, "runner-1")
+		}
+	}
+
+	// Bearer is advertised only when Tokens is set
+	rr := httptest.NewRecorder()
+	(&Server{Host: "localhost", Tokens: v}).ServeHTTP(rr, httptest.NewRequest("GET", "http://other.com/", nil))
+	if got := rr.Header()["Proxy-Authenticate"]; len(got) != 2 {
+		t.Errorf("got challenges %v want Basic and Bearer", got)
+	}
+	if rr.Code != http.StatusProxyAuthRequired {
+		t.Errorf("got %v want %v", rr.Code, http.StatusProxyAuthRequired)
+	}
+}
@@ -0,0 +1,269 @@
+package lib
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KeyStore keeps private keys as PEM files in Dir, readable only by the
+// owner. With a Passphrase, keys are written as encrypted PKCS#8.
+type KeyStore struct {
+	Dir        string
+	Passphrase []byte
+}
+
+func (ks *KeyStore) path(name string) string {
+	return filepath.Join(ks.Dir, name)
+}
+
+// Load reads the key called name. PKCS#8, PKCS#1 and SEC 1 keys are
+// accepted, and encrypted PKCS#8 if Passphrase is set.
+func (ks *KeyStore) Load(name string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(ks.path(name))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(b, ks.Passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", ks.path(name), err)
+	}
+	return key, nil
+}
+
+// Save writes key as name, creating Dir if needed.
+func (ks *KeyStore) Save(name string, key crypto.Signer) error {
+	b, err := MarshalPrivateKey(key, ks.Passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ks.Dir, 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file so that a failure doesn't leave a
+	// truncated key behind.
+	f, err := ioutil.TempFile(ks.Dir, name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), ks.path(name))
+}
+
+// ParsePrivateKey parses a PEM encoded RSA, ECDSA or Ed25519 key.
+func ParsePrivateKey(b []byte, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	der := block.Bytes
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, errors.New("key is encrypted, but no passphrase is given")
+		}
+		if der, err = decryptPKCS8(der, passphrase); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return k.(crypto.Signer), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// keyMatches reports whether key is the private key of pub.
+func keyMatches(key crypto.Signer, pub crypto.PublicKey) bool {
+	k, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(pub)
+}
+
+// MarshalPrivateKey returns key as PEM encoded PKCS#8, encrypted if
+// passphrase isn't nil.
+func MarshalPrivateKey(key crypto.Signer, passphrase []byte) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == nil {
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	if der, err = encryptPKCS8(der, passphrase); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// PKCS#8 encryption with PBES2 (RFC 8018), which the standard library
+// doesn't provide. Keys are encrypted with AES-256-CBC and a key derived by
+// PBKDF2 with HMAC-SHA256; other AES key sizes and HMAC-SHA1 are read too.
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algo pkix.AlgorithmIdentifier
+	Data []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Cipher pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func encryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: pbkdf2Iter,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Cipher: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, pbkdf2Iter, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(append([]byte(nil), der...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data: data,
+	})
+}
+
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption %v", info.Algo.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v", params.KDF.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	var h func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		h = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		h = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PRF %v", kdf.PRF.Algorithm)
+	}
+	var keyLen int
+	switch {
+	case params.Cipher.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.Cipher.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.Cipher.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported cipher %v", params.Cipher.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(info.Data) == 0 || len(info.Data)%aes.BlockSize != 0 {
+		return nil, errors.New("malformed encrypted key")
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.Iterations, keyLen, h))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.Data)
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(data[len(data)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("wrong passphrase")
+	}
+	return data[:len(data)-pad], nil
+}
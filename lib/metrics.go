@@ -0,0 +1,241 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics counts what Servers do, for Prometheus to scrape from /metrics.
+// One Metrics is shared by Servers replacing each other on reload. A nil
+// Metrics counts nothing.
+type Metrics struct {
+	mu            sync.Mutex
+	requests      map[[2]string]uint64 // By method and status
+	duration      histogram
+	bytes         map[string]uint64 // By direction
+	tunnels       map[string]int64  // Active, by protocol
+	dial          map[string]*histogram
+	dnsFailures   uint64
+	authFailures  map[string]uint64 // By reason
+	policyDenials uint64
+}
+
+// Buckets of latency histograms, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // Per bucket, and one more for +Inf
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+// knownMethods are counted by name; others as OTHER, so that clients can't
+// make up series.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "CONNECT": true,
+	"OPTIONS": true, "TRACE": true, "PATCH": true, "UDP": true,
+}
+
+// request counts a finished request or tunnel.
+func (m *Metrics) request(method string, status int, up, down int64, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[[2]string]uint64)
+		m.bytes = make(map[string]uint64)
+	}
+	m.requests[[2]string{method, strconv.Itoa(status)}]++
+	m.duration.observe(d.Seconds())
+	m.bytes["up"] += uint64(up)
+	m.bytes["down"] += uint64(down)
+}
+
+// tunnel counts an active tunnel of proto until the returned function is
+// called.
+func (m *Metrics) tunnel(proto string) func() {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	if m.tunnels == nil {
+		m.tunnels = make(map[string]int64)
+	}
+	m.tunnels[proto]++
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		m.tunnels[proto]--
+		m.mu.Unlock()
+	}
+}
+
+// dialed records the latency of connecting to an origin or upstream.
+// via is "direct" or the upstream.
+func (m *Metrics) dialed(via string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		if m.dial == nil {
+			m.dial = make(map[string]*histogram)
+		}
+		h := m.dial[via]
+		if h == nil {
+			h = &histogram{}
+			m.dial[via] = h
+		}
+		h.observe(time.Since(start).Seconds())
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		m.dnsFailures++
+	}
+}
+
+// resolveFailed counts err if it's a failure to resolve a name.
+func (m *Metrics) resolveFailed(err error) {
+	var dnsErr *net.DNSError
+	if m == nil || !errors.As(err, &dnsErr) {
+		return
+	}
+	m.mu.Lock()
+	m.dnsFailures++
+	m.mu.Unlock()
+}
+
+// authFailed counts a client failing authentication with err.
+func (m *Metrics) authFailed(err error) {
+	if m == nil {
+		return
+	}
+	reason := "invalid"
+	if err == errNoCredentials {
+		reason = "missing"
+	}
+	m.mu.Lock()
+	if m.authFailures == nil {
+		m.authFailures = make(map[string]uint64)
+	}
+	m.authFailures[reason]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) policyDenied() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.policyDenials++
+	m.mu.Unlock()
+}
+
+// escapeLabel escapes a label value for the text format.
+var escapeLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var n uint64
+	for i, le := range latencyBuckets {
+		if h.counts != nil {
+			n += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, le, n)
+	}
+	if h.counts != nil {
+		n += h.counts[len(latencyBuckets)]
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, n)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, labels, h.sum, name, labels, n)
+}
+
+// WriteText writes m in the Prometheus text exposition format.
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header(w, "javertd_requests_total", "counter", "Requests and tunnels served, by method and status.")
+	var reqs [][2]string
+	for k := range m.requests {
+		reqs = append(reqs, k)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i][0] < reqs[j][0] || reqs[i][0] == reqs[j][0] && reqs[i][1] < reqs[j][1]
+	})
+	for _, k := range reqs {
+		fmt.Fprintf(w, "javertd_requests_total{method=%q,status=%q} %d\n", k[0], k[1], m.requests[k])
+	}
+	header(w, "javertd_request_duration_seconds", "histogram", "Time to serve requests and tunnels.")
+	writeHistogram(w, "javertd_request_duration_seconds", "", &m.duration)
+	header(w, "javertd_bytes_total", "counter", "Bytes relayed from (up) and to (down) clients.")
+	for _, dir := range []string{"up", "down"} {
+		fmt.Fprintf(w, "javertd_bytes_total{direction=%q} %d\n", dir, m.bytes[dir])
+	}
+	header(w, "javertd_tunnels_active", "gauge", "Tunnels open, by protocol.")
+	for _, proto := range []string{"HTTP/1.1", "HTTP/2", "SOCKS"} {
+		fmt.Fprintf(w, "javertd_tunnels_active{proto=%q} %d\n", proto, m.tunnels[proto])
+	}
+	header(w, "javertd_dial_duration_seconds", "histogram", "Time to connect to origins (direct) and upstreams.")
+	var vias []string
+	for via := range m.dial {
+		vias = append(vias, via)
+	}
+	sort.Strings(vias)
+	for _, via := range vias {
+		writeHistogram(w, "javertd_dial_duration_seconds", `via="`+escapeLabel(via)+`"`, m.dial[via])
+	}
+	header(w, "javertd_dns_failures_total", "counter", "Destination names that failed to resolve.")
+	fmt.Fprintf(w, "javertd_dns_failures_total %d\n", m.dnsFailures)
+	header(w, "javertd_auth_failures_total", "counter", "Failed client authentications, by reason (missing or invalid credentials).")
+	for _, reason := range []string{"missing", "invalid"} {
+		fmt.Fprintf(w, "javertd_auth_failures_total{reason=%q} %d\n", reason, m.authFailures[reason])
+	}
+	header(w, "javertd_policy_denials_total", "counter", "Requests denied by the destination policy.")
+	fmt.Fprintf(w, "javertd_policy_denials_total %d\n", m.policyDenials)
+}
+
+func (srv *Server) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if _, err := srv.checkAuth(req, authorization); err != nil {
+		srv.unauthorized(w, req, err)
+		return
+	}
+	if srv.Metrics == nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	srv.Metrics.WriteText(w)
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer ts.Close()
+
+	rules, _ := ParsePolicy(strings.NewReader("deny method=DELETE\nallow\n"))
+	proxy := httptest.NewServer(&Server{Host: "proxy", User: "user", Pass: "pass", Policy: NewPolicy(rules), Metrics: &Metrics{}})
+	defer proxy.Close()
+
+	c := getProxiedClient(proxy)
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	req, _ := http.NewRequest("DELETE", ts.URL, nil)
+	if resp, err = c.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	u, _ := url.Parse(proxy.URL)
+	if resp, err = (&http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}).Get(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Keep a tunnel open while scraping.
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", host, host)
+	if resp, err = http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+
+	req, _ = http.NewRequest("GET", proxy.URL+"/metrics", nil)
+	req.Host = "proxy"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %v without credentials", resp.Status)
+	}
+	req.SetBasicAuth("user", "pass")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	m := string(b)
+	for _, want := range []string{
+		"javertd_requests_total{method=\"GET\",status=\"200\"} 1\n",
+		"javertd_requests_total{method=\"GET\",status=\"407\"} 1\n",
+		"javertd_requests_total{method=\"DELETE\",status=\"403\"} 1\n",
+		"javertd_request_duration_seconds_count 3\n", // Not counting scrapes
+		"javertd_bytes_total{direction=\"down\"} ",
+		"javertd_tunnels_active{proto=\"HTTP/1.1\"} 1\n",
+		"javertd_dial_duration_seconds_count{via=\"direct\"} 2\n",
+		"javertd_auth_failures_total{reason=\"missing\"} 1\n",
+		"javertd_policy_denials_total 1\n",
+	} {
+		if !strings.Contains(m, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, m)
+		}
+	}
+
+	// Handlers that write nothing respond 200
+	srv := &Server{Host: "proxy", Metrics: &Metrics{}}
+	srv.recordDone(srv.record(httptest.NewRequest("GET", "http://example.com/", nil)))
+	var sb strings.Builder
+	srv.Metrics.WriteText(&sb)
+	if want := "javertd_requests_total{method=\"GET\",status=\"200\"} 1\n"; !strings.Contains(sb.String(), want) {
+		t.Errorf("metrics don't contain %q:\n%s", want, sb.String())
+	}
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// PAC files, served as /proxy.pac and /wpad.dat on Host, send browsers
+// through this proxy except for destinations routed direct. Conditions a
+// browser can't evaluate (user and method) send it to the proxy, which
+// then decides itself.
+const pacPreamble = `// Generated by javertd from its routes.
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	var scheme = url.substring(0, url.indexOf(":"));
+	var authority = url.substring(scheme.length + 3).split("/")[0];
+	authority = authority.substring(authority.lastIndexOf("@") + 1);
+	var port = {http: 80, https: 443, ws: 80, wss: 443, ftp: 21}[scheme];
+	var m = authority.match(/:(\d+)$/);
+	if (m) {
+		port = parseInt(m[1], 10);
+	}
+	// Only http and ftp are forwarded; the rest is tunneled
+	if (scheme != "http" && scheme != "ftp") {
+		scheme = "";
+	}
+	var ip;
+	function inNet(net, mask) {
+		if (ip === undefined) {
+			ip = dnsResolve(host);
+		}
+		return ip !== null && isInNet(ip, net, mask);
+	}
+`
+
+// globRegexp returns a JavaScript regular expression literal matching what
+// the path.Match pattern p does.
+func globRegexp(p string) string {
+	var b strings.Builder
+	b.WriteString("/^")
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(p) {
+				i++
+				b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+			}
+		case '[':
+			if j := strings.IndexByte(p[i:], ']'); j > 0 {
+				b.WriteString("[" + strings.ReplaceAll(p[i+1:i+j], "/", `\/`) + "]")
+				i += j
+				continue
+			}
+			b.WriteString(`\[`)
+		case '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$/")
+	return b.String()
+}
+
+func pacGlobs(patterns []string, v string) string {
+	var l []string
+	for _, p := range patterns {
+		l = append(l, globRegexp(p)+".test("+v+")")
+	}
+	return "(" + strings.Join(l, " || ") + ")"
+}
+
+// pacCondition returns the JavaScript expression for the conditions of r
+// a browser can evaluate, and whether that's all of them.
+func pacCondition(r *Rule) (string, bool) {
+	var l []string
+	if len(r.Hosts) > 0 {
+		l = append(l, pacGlobs(r.Hosts, "host"))
+	}
+	exact := len(r.Users) == 0 && len(r.Methods) == 0
+	if len(r.Nets) > 0 {
+		var nets []string
+		for _, n := range r.Nets {
+			if n.IP.To4() == nil {
+				// isInNet only handles IPv4.
+				exact = false
+				continue
+			}
+			nets = append(nets, fmt.Sprintf("inNet(%q, %q)", n.IP.String(), net.IP(n.Mask).String()))
+		}
+		if len(nets) > 0 {
+			l = append(l, "("+strings.Join(nets, " || ")+")")
+		}
+	}
+	if len(r.Ports) > 0 {
+		var ports []string
+		for _, p := range r.Ports {
+			ports = append(ports, fmt.Sprintf("(port >= %d && port <= %d)", p.lo, p.hi))
+		}
+		l = append(l, "("+strings.Join(ports, " || ")+")")
+	}
+	if len(r.Schemes) > 0 {
+		l = append(l, pacGlobs(r.Schemes, "scheme"))
+	}
+	if len(l) == 0 {
+		return "true", exact
+	}
+	return strings.Join(l, " && "), exact
+}
+
+// PAC returns a proxy auto-config script sending browsers to proxy, a
+// PAC directive such as "PROXY proxy.example.com:1080", except where
+// Routes connect directly.
+func (srv *Server) PAC(proxy string) string {
+	var b strings.Builder
+	b.WriteString(pacPreamble)
+	for _, r := range srv.Routes {
+		cond, exact := pacCondition(&r.rule)
+		action := proxy
+		if r.Pool == nil && exact {
+			action = "DIRECT"
+		}
+		fmt.Fprintf(&b, "\t// %s\n\tif (%s) {\n\t\treturn %q;\n\t}\n", strings.Join(strings.Fields(r.rule.text), " "), cond, action)
+	}
+	fmt.Fprintf(&b, "\treturn %q;\n}\n", proxy)
+	return b.String()
+}
+
+func (srv *Server) servePAC(w http.ResponseWriter, req *http.Request) {
+	directive := "PROXY "
+	if req.TLS != nil {
+		directive = "HTTPS "
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprint(w, srv.PAC(directive+req.Host))
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		glob    string
+		samples []string
+	}{
+		{"*.example.com", []string{"www.example.com", "example.com", "a.b.example.com", "wwwxexample.com"}},
+		{"host?.corp", []string{"host1.corp", "host.corp", "host12.corp"}},
+		{"[a-c]*", []string{"apple", "dog", "c"}},
+		{"[^a-c]*", []string{"apple", "dog"}},
+		{`a\*b+c`, []string{"a*b+c", "axb+c", "a*bbc"}},
+	} {
+		js := globRegexp(tc.glob)
+		// JavaScript and Go agree on this subset of the syntax.
+		re, err := regexp.Compile(strings.ReplaceAll(js[1:len(js)-1], `\/`, "/"))
+		if err != nil {
+			t.Errorf("%s: %s: %v", tc.glob, js, err)
+			continue
+		}
+		for _, s := range tc.samples {
+			want, _ := path.Match(tc.glob, s)
+			if got := re.MatchString(s); got != want {
+				t.Errorf("%s: %s matching %q: got %v want %v", tc.glob, js, s, got, want)
+			}
+		}
+	}
+}
+
+func TestPAC(t *testing.T) {
+	corp := &Pool{Name: "corp"}
+	var routes []*Route
+	for i, line := range []string{
+		"corp user=admin host=*.corp.example.com",
+		"direct host=*.corp.example.com,intranet",
+		"direct cidr=10.0.0.0/8 port=80,8000-8999",
+		"direct cidr=fc00::/7",
+		"corp",
+	} {
+		r, err := ParseRoute(line, i+1, map[string]*Pool{"corp": corp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, r)
+	}
+	proxy := httptest.NewServer(&Server{Host: "proxy", Routes: routes})
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/proxy.pac", nil)
+	req.Host = "proxy"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	pac := string(b)
+	for _, want := range []string{
+		// The browser can't tell users apart
+		"\t// corp user=admin host=*.corp.example.com\n\tif ((/^[^/]*\\.corp\\.example\\.com$/.test(host))) {\n\t\treturn \"PROXY proxy\";\n\t}\n",
+		"\tif ((/^[^/]*\\.corp\\.example\\.com$/.test(host) || /^intranet$/.test(host))) {\n\t\treturn \"DIRECT\";\n\t}\n",
+		"\tif ((inNet(\"10.0.0.0\", \"255.0.0.0\")) && ((port >= 80 && port <= 80) || (port >= 8000 && port <= 8999))) {\n\t\treturn \"DIRECT\";\n\t}\n",
+		// isInNet can't check IPv6
+		"\t// direct cidr=fc00::/7\n\tif (true) {\n\t\treturn \"PROXY proxy\";\n\t}\n",
+		"\treturn \"PROXY proxy\";\n}\n",
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC doesn't contain %q:\n%s", want, pac)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Password hash algorithms understood by HashPassword.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+	HashPBKDF2   = "pbkdf2"
+)
+
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	pbkdf2Iter    = 600000
+	saltLen       = 16
+	keyLen        = 32
+)
+
+var b64 = base64.RawStdEncoding
+
+// HashPassword returns pass hashed with algo in a format accepted by
+// Server.PassHash and htpasswd files.
+//
+//	bcrypt:   $2a$10$...
+//	argon2id: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+//	pbkdf2:   $pbkdf2-sha256$600000$<salt>$<key>
+func HashPassword(algo, pass string) (string, error) {
+	if algo == HashBcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+		return string(b), err
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	switch algo {
+	case HashArgon2id:
+		key := argon2.IDKey([]byte(pass), salt, argon2Time, argon2Memory, argon2Threads, keyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case HashPBKDF2:
+		key := pbkdf2.Key([]byte(pass), salt, pbkdf2Iter, keyLen, sha256.New)
+		return fmt.Sprintf("$pbkdf2-sha256$%d$%s$%s", pbkdf2Iter, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q", algo)
+}
+
+// SupportedHash reports whether hash is in a format checked by
+// Server.PassHash and htpasswd files.
+func SupportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return true
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, _, _, _, _, err := parseArgon2(hash)
+		return err == nil
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		_, _, _, err := parsePBKDF2(hash)
+		return err == nil
+	}
+	return false
+}
+
+// checkHash verifies pass against hash. Unknown formats never match.
+func checkHash(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(want)) == 1
+	case strings.HasPrefix(hash, "$argon2id$"):
+		m, t, p, salt, key, err := parseArgon2(hash)
+		if err != nil {
+			return false
+		}
+		got := argon2.IDKey([]byte(pass), salt, t, m, p, uint32(len(key)))
+		return subtle.ConstantTimeCompare(got, key) == 1
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		iter, salt, key, err := parsePBKDF2(hash)
+		if err != nil {
+			return false
+		}
+		got := pbkdf2.Key([]byte(pass), salt, iter, len(key), sha256.New)
+		return subtle.ConstantTimeCompare(got, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+func parseArgon2(hash string) (m, t uint32, p uint8, salt, key []byte, err error) {
+	f := strings.Split(hash, "$")
+	if len(f) != 6 || f[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return 0, 0, 0, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+	if _, err = fmt.Sscanf(f[3], "m=%d,t=%d,p=%d", &m, &t, &p); err != nil {
+		return
+	}
+	if t < 1 || p < 1 {
+		return 0, 0, 0, nil, nil, fmt.Errorf("malformed argon2id hash: t and p must be positive")
+	}
+	if salt, err = b64.DecodeString(f[4]); err != nil {
+		return
+	}
+	if key, err = b64.DecodeString(f[5]); err == nil && (len(salt) == 0 || len(key) == 0) {
+		err = fmt.Errorf("malformed argon2id hash: empty salt or key")
+	}
+	return
+}
+
+func parsePBKDF2(hash string) (iter int, salt, key []byte, err error) {
+	f := strings.Split(hash, "$")
+	if len(f) != 5 {
+		return 0, nil, nil, fmt.Errorf("malformed pbkdf2 hash")
+	}
+	if iter, err = strconv.Atoi(f[2]); err != nil {
+		return
+	}
+	if iter < 1 {
+		return 0, nil, nil, fmt.Errorf("malformed pbkdf2 hash: iterations must be positive")
+	}
+	if salt, err = b64.DecodeString(f[3]); err != nil {
+		return
+	}
+	if key, err = b64.DecodeString(f[4]); err == nil && (len(salt) == 0 || len(key) == 0) {
+		err = fmt.Errorf("malformed pbkdf2 hash: empty salt or key")
+	}
+	return
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
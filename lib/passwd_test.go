@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	for _, algo := range []string{HashBcrypt, HashArgon2id, HashPBKDF2} {
+		h, err := HashPassword(algo, "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		if !SupportedHash(h) {
+			t.Errorf("%s: %q is not supported", algo, h)
+		}
+		if !checkHash(h, "secret") {
+			t.Errorf("%s: checkHash rejected correct password", algo)
+		}
+		if checkHash(h, "Secret") {
+			t.Errorf("%s: checkHash accepted wrong password", algo)
+		}
+	}
+	if _, err := HashPassword("md5", "secret"); err == nil {
+		t.Errorf("HashPassword accepted unknown algorithm")
+	}
+}
+
+func TestMalformedHash(t *testing.T) {
+	for _, h := range []string{
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=0$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=4$$a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$",
+		"$pbkdf2-sha256$0$c2FsdA$a2V5a2V5",
+		"$pbkdf2-sha256$-1$c2FsdA$a2V5a2V5",
+		"$pbkdf2-sha256$1000$$a2V5a2V5",
+		"$pbkdf2-sha256$1000$c2FsdA$",
+	} {
+		if SupportedHash(h) {
+			t.Errorf("%q is supported", h)
+		}
+		if checkHash(h, "") || checkHash(h, "anything") {
+			t.Errorf("%q accepted a password", h)
+		}
+	}
+}
+
+func TestPassHash(t *testing.T) {
+	h, _ := HashPassword(HashPBKDF2, "pass")
+	s := &Server{Host: "example.com", User: "user", PassHash: h}
+	for _, c := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"user", "pass", true},
+		{"user", "", false},
+		{"other", "pass", false},
+	} {
+		r, _ := http.NewRequest("GET", "http://other.com", nil)
+		r.SetBasicAuth(c.user, c.pass)
+		r.Header.Set(proxyAuthorization, r.Header.Get(authorization))
+		if _, err := s.checkAuth(r, proxyAuthorization); (err == nil) != c.want {
+			t.Errorf("checkAuth(%q, %q) = %v want ok=%v", c.user, c.pass, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Destination describes a request to be checked against a Policy.
+type Destination struct {
+	User   string // Empty for anonymous requests
+	Method string
+	Scheme string // Empty for CONNECT
+	Host   string // Without port
+	Port   int
+	IPs    []net.IP // Resolved addresses of Host
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+// Rule is a single line of a policy file:
+//
+//	allow|deny [user=GLOB,...] [host=GLOB,...] [cidr=CIDR,...]
+//	           [port=N|N-M,...] [method=M,...] [scheme=S,...]
+//
+// All given conditions must hold, and any value of a condition may match.
+// Globs follow path.Match. A cidr condition of an allow rule matches when
+// all resolved addresses are in range; of a deny rule, when any of them is.
+type Rule struct {
+	Allow   bool
+	Users   []string
+	Hosts   []string
+	Nets    []*net.IPNet
+	Ports   []portRange
+	Methods []string
+	Schemes []string
+
+	Line int
+	text string
+}
+
+func (r *Rule) String() string {
+	if r == nil {
+		return "no rule"
+	}
+	return fmt.Sprintf("line %d %q", r.Line, r.text)
+}
+
+func globMatch(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchIPs(ips []net.IP) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		in := false
+		for _, n := range r.Nets {
+			if n.Contains(ip) {
+				in = true
+				break
+			}
+		}
+		if in != r.Allow {
+			return !r.Allow
+		}
+	}
+	return r.Allow
+}
+
+func (r *Rule) match(d *Destination) bool {
+	if len(r.Users) > 0 && !globMatch(r.Users, d.User) {
+		return false
+	}
+	if len(r.Hosts) > 0 && !globMatch(r.Hosts, strings.ToLower(d.Host)) {
+		return false
+	}
+	if len(r.Nets) > 0 && !r.matchIPs(d.IPs) {
+		return false
+	}
+	if len(r.Ports) > 0 {
+		ok := false
+		for _, p := range r.Ports {
+			ok = ok || (p.lo <= d.Port && d.Port <= p.hi)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.Methods) > 0 && !globMatch(r.Methods, d.Method) {
+		return false
+	}
+	if len(r.Schemes) > 0 && !globMatch(r.Schemes, d.Scheme) {
+		return false
+	}
+	return true
+}
+
+// ParseRule parses a single rule. n is the line number used in errors.
+func ParseRule(line string, n int) (*Rule, error) {
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return nil, fmt.Errorf("line %d: empty rule", n)
+	}
+	r := &Rule{Line: n, text: line}
+	switch f[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("line %d: unknown action %q", n, f[0])
+	}
+	if err := r.parseConditions(f[1:]); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Rule) parseConditions(f []string) error {
+	n := r.Line
+	for _, kv := range f {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[1] == "" {
+			return fmt.Errorf("line %d: malformed condition %q", n, kv)
+		}
+		values := strings.Split(p[1], ",")
+		switch p[0] {
+		case "user":
+			r.Users = append(r.Users, values...)
+		case "host":
+			for _, v := range values {
+				r.Hosts = append(r.Hosts, strings.ToLower(v))
+			}
+		case "cidr":
+			for _, v := range values {
+				_, ipnet, err := net.ParseCIDR(v)
+				if err != nil {
+					return fmt.Errorf("line %d: %v", n, err)
+				}
+				r.Nets = append(r.Nets, ipnet)
+			}
+		case "port":
+			for _, v := range values {
+				lh := strings.SplitN(v, "-", 2)
+				lo, err := strconv.Atoi(lh[0])
+				hi := lo
+				if err == nil && len(lh) == 2 {
+					hi, err = strconv.Atoi(lh[1])
+				}
+				if err != nil || lo > hi {
+					return fmt.Errorf("line %d: bad port %q", n, v)
+				}
+				r.Ports = append(r.Ports, portRange{lo, hi})
+			}
+		case "method":
+			for _, v := range values {
+				r.Methods = append(r.Methods, strings.ToUpper(v))
+			}
+		case "scheme":
+			for _, v := range values {
+				r.Schemes = append(r.Schemes, strings.ToLower(v))
+			}
+		default:
+			return fmt.Errorf("line %d: unknown condition %q", n, p[0])
+		}
+	}
+	return nil
+}
+
+// Policy is an ordered list of Rules loaded from a file. The first matching
+// rule decides; a request matching no rule is denied.
+type Policy struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []*Rule
+}
+
+// NewPolicy returns a Policy with fixed rules.
+func NewPolicy(rules []*Rule) *Policy {
+	return &Policy{rules: rules}
+}
+
+// LoadPolicy returns a Policy read from path.
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the file. On error the previous rules are kept.
+func (p *Policy) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := ParsePolicy(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p.path, err)
+	}
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+	return nil
+}
+
+// ParsePolicy parses policy rules, one per line. Blank lines and lines
+// starting with # are ignored.
+func ParsePolicy(rd io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+	s := bufio.NewScanner(rd)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseRule(line, n)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, s.Err()
+}
+
+// needsIPs reports whether any rule has a cidr condition.
+func (p *Policy) needsIPs() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.rules {
+		if len(r.Nets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first rule matching d, or nil.
+func (p *Policy) Match(d *Destination) *Rule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, r := range p.rules {
+		if r.match(d) {
+			return r
+		}
+	}
+	return nil
+}
+
+var errPolicyDenied = &forbiddenError{"denied by policy"}
+
+// defaultPort returns u.Host with the scheme's default port if it has none.
+func defaultPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// destination describes req going to hostport. IPs are resolved only if
+// needed. If that fails, the Destination is returned without them along
+// with the error.
+func destination(req *http.Request, scheme, hostport string, needIPs bool) (*Destination, error) {
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, err
+	}
+	d := &Destination{Method: req.Method, Scheme: scheme, Host: host, Port: port}
+	if id := IdentityFromContext(req.Context()); id != nil {
+		d.User = id.User
+	}
+	if needIPs {
+		if ip := parseIP(host); ip != nil {
+			d.IPs = []net.IP{ip}
+		} else {
+			ctx, span := startSpan(req.Context(), "resolve", trace.WithAttributes(attribute.String("server.address", host)))
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			endSpan(span, err)
+			if err != nil {
+				return d, err
+			}
+			for _, a := range addrs {
+				d.IPs = append(d.IPs, a.IP)
+			}
+		}
+	}
+	return d, nil
+}
+
+const destinationKey contextKey = 3
+
+// checkPolicy applies srv.Policy to req going to hostport, and logs the
+// decision. If the Policy has cidr rules, the returned request carries the
+// Destination for checkDialed.
+func (srv *Server) checkPolicy(req *http.Request, scheme, hostport string) (*http.Request, error) {
+	if srv.Policy == nil {
+		return req, nil
+	}
+	needIPs := srv.Policy.needsIPs()
+	d, err := destination(req, scheme, hostport, needIPs)
+	if err != nil {
+		srv.Metrics.resolveFailed(err)
+		return req, err
+	}
+
+	r := srv.Policy.Match(d)
+	if r == nil || !r.Allow {
+		srv.Metrics.policyDenied()
+		log.Printf("policy: user=%q %s %s denied by %v", d.User, req.Method, hostport, r)
+		return req, errPolicyDenied
+	}
+	log.Printf("policy: user=%q %s %s allowed by %v", d.User, req.Method, hostport, r)
+	if needIPs {
+		req = req.WithContext(context.WithValue(req.Context(), destinationKey, d))
+	}
+	return req, nil
+}
+
+// checkDialed applies srv.Policy again to the Destination allowed by
+// checkPolicy, with the address actually being connected to instead of the
+// IPs it was resolved to then, so that DNS rebinding can't bypass cidr rules.
+func (srv *Server) checkDialed(ctx context.Context, address string) error {
+	d, _ := ctx.Value(destinationKey).(*Destination)
+	if d == nil || srv.Policy == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	ip := parseIP(host)
+	if err != nil || ip == nil {
+		srv.Metrics.policyDenied()
+		log.Printf("policy: user=%q %s:%d at %q denied: not an IP address", d.User, d.Host, d.Port, address)
+		return errPolicyDenied
+	}
+	dialed := *d
+	dialed.IPs = []net.IP{ip}
+	if r := srv.Policy.Match(&dialed); r == nil || !r.Allow {
+		srv.Metrics.policyDenied()
+		log.Printf("policy: user=%q %s:%d at %s denied by %v", d.User, d.Host, d.Port, host, r)
+		return errPolicyDenied
+	}
+	return nil
+}
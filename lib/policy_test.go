@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+# comment
+deny port=25
+allow user=alice host=*.example.com,example.com port=80,443,8000-8999
+deny cidr=10.0.0.0/8
+allow method=CONNECT port=443
+allow user=bob scheme=http
+`
+
+func TestPolicyMatch(t *testing.T) {
+	rules, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPolicy(rules)
+	for _, c := range []struct {
+		d        Destination
+		wantLine int
+		wantOK   bool
+	}{
+		{Destination{User: "alice", Method: "GET", Host: "www.example.com", Port: 25}, 3, false},
+		{Destination{User: "alice", Method: "GET", Host: "WWW.Example.com", Port: 8080}, 4, true},
+		{Destination{User: "alice", Method: "GET", Host: "example.org", Port: 80}, 0, false},
+		{Destination{User: "carol", Method: "CONNECT", Host: "intra", Port: 443,
+			IPs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("10.1.2.3")}}, 5, false},
+		{Destination{User: "carol", Method: "CONNECT", Host: "www.example.org", Port: 443,
+			IPs: []net.IP{net.ParseIP("192.0.2.1")}}, 6, true},
+		{Destination{User: "bob", Method: "POST", Scheme: "http", Host: "example.net", Port: 80}, 7, true},
+		{Destination{User: "bob", Method: "CONNECT", Host: "example.net", Port: 22}, 0, false},
+	} {
+		r := p.Match(&c.d)
+		line, ok := 0, false
+		if r != nil {
+			line, ok = r.Line, r.Allow
+		}
+		if line != c.wantLine || ok != c.wantOK {
+			t.Errorf("%+v: got line %d allow=%v want line %d allow=%v", c.d, line, ok, c.wantLine, c.wantOK)
+		}
+	}
+}
+
+func TestParsePolicyError(t *testing.T) {
+	for _, s := range []string{
+		"permit",
+		"allow port=80-20",
+		"allow cidr=10.0.0.0",
+		"deny foo=bar",
+		"deny host=",
+	} {
+		if _, err := ParsePolicy(strings.NewReader("allow\n" + s)); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: got %v want error on line 2", s, err)
+		}
+	}
+}
+
+func TestPolicyProxy(t *testing.T) {
+	rules, _ := ParsePolicy(strings.NewReader("allow user=alice\ndeny user=bob\n"))
+	proxy := httptest.NewServer(&Server{Host: "localhost", Credentials: credentialFunc(func(u, p string) bool { return u == p }), Policy: NewPolicy(rules)})
+	defer proxy.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		user string
+		want int
+	}{
+		{"alice", http.StatusOK},
+		{"bob", http.StatusForbidden},
+		{"carol", http.StatusForbidden},
+	} {
+		u, _ := url.Parse(proxy.URL)
+		u.User = url.UserPassword(c.user, c.user)
+		cl := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+		resp, err := cl.Get(ts.URL)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s: got %v want %v", c.user, resp.StatusCode, c.want)
+		}
+	}
+}
+
+func TestPolicyUnresolved(t *testing.T) {
+	rules, _ := ParsePolicy(strings.NewReader("deny cidr=10.0.0.0/8\nallow\n"))
+	srv := &Server{Policy: NewPolicy(rules)}
+	req := httptest.NewRequest("GET", "http://nonexistent.invalid/", nil)
+	var dnsErr *net.DNSError
+	if _, err := srv.checkPolicy(req, "http", "nonexistent.invalid:80"); !errors.As(err, &dnsErr) {
+		t.Errorf("got %v want a DNS error", err)
+	}
+}
+
+func TestPolicyRebinding(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	rules, _ := ParsePolicy(strings.NewReader("deny cidr=127.0.0.0/8\nallow\n"))
+	srv := &Server{Policy: NewPolicy(rules)}
+
+	// A name allowed for its public address, then resolved to loopback
+	d := &Destination{Method: "CONNECT", Host: "rebind.example.com", Port: 443, IPs: []net.IP{net.ParseIP("192.0.2.1")}}
+	ctx := context.WithValue(context.Background(), destinationKey, d)
+	if c, err := srv.dial(ctx, "tcp", ln.Addr().String()); !isForbidden(err) {
+		if c != nil {
+			c.Close()
+		}
+		t.Errorf("got %v want denied by policy", err)
+	}
+
+	// Or to a zoned link-local one, with only a host rule allowing it
+	rules, _ = ParsePolicy(strings.NewReader("deny cidr=fe80::/10\nallow host=rebind.example.com\n"))
+	srv.Policy = NewPolicy(rules)
+	for _, a := range []string{"[fe80::1%lo]:9", "bogus"} {
+		if err := srv.checkDialed(ctx, a); err != errPolicyDenied {
+			t.Errorf("%s: got %v want denied by policy", a, err)
+		}
+	}
+}
+
+type credentialFunc func(user, pass string) bool
+
+func (f credentialFunc) Check(user, pass string) bool {
+	return f(user, pass)
+}
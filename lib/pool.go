@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Pool is a set of interchangeable upstreams. Connections are spread over
+// the healthy ones by Weight, and fail over to another when an upstream
+// can't be reached.
+type Pool struct {
+	Name      string
+	Upstreams []*Upstream
+}
+
+func (p *Pool) String() string {
+	return p.Name
+}
+
+// pick chooses an upstream not in tried, preferring healthy ones. It
+// returns nil when all have been tried.
+func (p *Pool) pick(tried map[*Upstream]bool) *Upstream {
+	for _, healthyOnly := range []bool{true, false} {
+		var candidates []*Upstream
+		total := 0
+		for _, u := range p.Upstreams {
+			if tried[u] || healthyOnly && !u.Healthy() {
+				continue
+			}
+			candidates = append(candidates, u)
+			total += weight(u)
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		n := rand.Intn(total)
+		for _, u := range candidates {
+			if n -= weight(u); n < 0 {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+func weight(u *Upstream) int {
+	if u.Weight < 1 {
+		return 1
+	}
+	return u.Weight
+}
+
+// failed records that u couldn't be reached.
+func (p *Pool) failed(u *Upstream, err error) {
+	if u.Healthy() {
+		u.setDown(time.Now().Add(upstreamRetry), err)
+	}
+}
+
+// dialTunnel opens a tunnel to hostport through one of the upstreams,
+// trying the others while they can't be reached.
+func (p *Pool) dialTunnel(ctx context.Context, hostport string) (net.Conn, error) {
+	tried := make(map[*Upstream]bool)
+	var err error
+	for u := p.pick(tried); u != nil; u = p.pick(tried) {
+		var c net.Conn
+		if c, err = u.dialTunnel(ctx, hostport); err == nil || !isUpstreamDown(err) || ctx.Err() != nil {
+			return c, err
+		}
+		p.failed(u, err)
+		tried[u] = true
+	}
+	return nil, err
+}
+
+// idempotentMethods are safe to send again after a failure. See RFC 7231
+// Section 4.2.2.
+var idempotentMethods = map[string]bool{
+	"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "PUT": true, "DELETE": true,
+}
+
+// RoundTrip forwards req through one of the upstreams. It's retried on
+// another if the upstream couldn't be reached, or, for idempotent
+// requests, if it failed before responding. Requests with a body aren't
+// retried since it may have been consumed.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*Upstream]bool)
+	var err error
+	for u := p.pick(tried); u != nil; u = p.pick(tried) {
+		var resp *http.Response
+		if resp, err = u.transport().RoundTrip(req); err == nil {
+			return resp, nil
+		}
+		down := isUpstreamDown(err)
+		if down {
+			p.failed(u, err)
+		}
+		if req.Body != nil && req.Body != http.NoBody || req.Context().Err() != nil || !down && !idempotentMethods[req.Method] {
+			return nil, err
+		}
+		tried[u] = true
+	}
+	return nil, err
+}
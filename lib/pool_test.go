@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deadUpstream returns an upstream nothing listens on.
+func deadUpstream(t *testing.T) *Upstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	u, _ := ParseUpstream("http://" + l.Addr().String())
+	return u
+}
+
+func TestPoolFailover(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+	parent := httptest.NewServer(&Server{Host: "parent", AllowAnonymous: true})
+	defer parent.Close()
+	live, _ := ParseUpstream(parent.URL)
+	dead := deadUpstream(t)
+	// The dead upstream is picked first
+	dead.Weight = 1000000
+
+	p := &Pool{Name: "pool", Upstreams: []*Upstream{dead, live}}
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	resp, err := p.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if dead.Healthy() || !live.Healthy() {
+		t.Errorf("got dead %v, live %v", dead.Healthy(), live.Healthy())
+	}
+	// Unhealthy upstreams are avoided
+	for i := 0; i < 10; i++ {
+		if u := p.pick(nil); u != live {
+			t.Fatalf("picked %v", u)
+		}
+	}
+
+	dead.setDown(time.Time{}, nil)
+	c, err := p.dialTunnel(context.Background(), strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if dead.Healthy() {
+		t.Errorf("dead upstream is healthy after dialTunnel")
+	}
+
+	// A request with a body isn't retried
+	dead.setDown(time.Time{}, nil)
+	req, _ = http.NewRequest("POST", ts.URL, strings.NewReader("x"))
+	if _, err := p.RoundTrip(req); !isUpstreamDown(err) {
+		t.Errorf("POST: got %v", err)
+	}
+
+	// All down
+	p.Upstreams = []*Upstream{dead}
+	if _, err := p.dialTunnel(context.Background(), "localhost:1"); dialErrorStatus(err) != http.StatusBadGateway {
+		t.Errorf("all down: got %v", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	parent := httptest.NewServer(&Server{Host: "parent", AllowAnonymous: true})
+	defer parent.Close()
+	live, _ := ParseUpstream(parent.URL)
+	dead := deadUpstream(t)
+	live.setDown(time.Now().Add(time.Hour), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go live.HealthCheck(ctx, 10*time.Millisecond, "")
+	go dead.HealthCheck(ctx, 10*time.Millisecond, "")
+	time.Sleep(100 * time.Millisecond)
+	if dead.Healthy() || !live.Healthy() {
+		t.Errorf("got dead %v, live %v", dead.Healthy(), live.Healthy())
+	}
+}
@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// AtomicServer serves requests with the most recently stored Server, so
+// that configuration can be swapped while listening. Requests already being
+// served, including CONNECT tunnels, keep using the Server they started with.
+type AtomicServer struct {
+	v atomic.Value
+}
+
+func NewAtomicServer(s *Server) *AtomicServer {
+	a := &AtomicServer{}
+	a.Store(s)
+	return a
+}
+
+func (a *AtomicServer) Store(s *Server) {
+	a.v.Store(s)
+}
+
+func (a *AtomicServer) Load() *Server {
+	return a.v.Load().(*Server)
+}
+
+func (a *AtomicServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.Load().ServeHTTP(w, req)
+}
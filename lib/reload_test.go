@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAtomicServer(t *testing.T) {
+	a := NewAtomicServer(&Server{Host: "localhost", User: "old", Pass: "pass"})
+	proxy := httptest.NewServer(a)
+	defer proxy.Close()
+	echo := createEchoServer()
+	defer echo.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic b2xkOnBhc3M=\r\n\r\n", echo.Addr(), echo.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+
+	a.Store(&Server{Host: "localhost", User: "new", Pass: "pass"})
+
+	// The established tunnel survives
+	io.WriteString(c, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+		t.Errorf("tunnel after Store: got %q, %v", b, err)
+	}
+
+	// New requests use the new Server
+	for _, user := range []string{"old", "new"} {
+		r, _ := http.NewRequest("GET", ts.URL, nil)
+		r.SetBasicAuth(user, "pass")
+		r.Header.Set(proxyAuthorization, r.Header.Get(authorization))
+		rr := httptest.NewRecorder()
+		a.ServeHTTP(rr, r)
+		want := http.StatusOK
+		if user == "old" {
+			want = http.StatusProxyAuthRequired
+		}
+		if rr.Code != want {
+			t.Errorf("%s: got %v want %v", user, rr.Code, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an append-only file that's renamed to Path.1 once it
+// would grow beyond MaxSize, keeping MaxBackups old files as Path.1 (the
+// newest) to Path.N. Rotation is disabled if MaxSize is 0.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.MaxSize {
+		r.rotate()
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file away and opens a new one. If that fails, writing
+// goes on to the current file, and rotation is tried again once another
+// MaxSize has been written.
+func (r *RotatingFile) rotate() {
+	for i := r.MaxBackups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.Path, i-1), fmt.Sprintf("%s.%d", r.Path, i))
+	}
+	var err error
+	if r.MaxBackups > 0 {
+		err = os.Rename(r.Path, r.Path+".1")
+	} else {
+		err = os.Remove(r.Path)
+	}
+	old := r.f
+	if err == nil {
+		err = r.open()
+	}
+	if err != nil {
+		log.Printf("Rotating %s: %v", r.Path, err)
+		r.size = 0
+		return
+	}
+	old.Close()
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
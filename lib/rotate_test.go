@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "javertd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+	for name, want := range map[string]string{
+		"access.log":   "dddddd\n",
+		"access.log.1": "cccccc\n",
+		"access.log.2": "bbbbbb\n",
+	} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v want %q", name, b, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3: got %v", path, err)
+	}
+
+	// Appends to what's there
+	r, _ = OpenRotatingFile(path, 0, 0)
+	r.Write([]byte("eeeeee\n"))
+	r.Close()
+	if b, _ := ioutil.ReadFile(path); string(b) != "dddddd\neeeeee\n" {
+		t.Errorf("got %q", b)
+	}
+
+	// Keeps writing to the file if it can't be moved away
+	os.Remove(path + ".1")
+	os.MkdirAll(filepath.Join(path+".1", "x"), 0755)
+	r, _ = OpenRotatingFile(path, 10, 1)
+	for _, s := range []string{"ffffff\n", "gggggg\n"} {
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Errorf("Write after failed rotation: %v", err)
+		}
+	}
+	r.Close()
+	if b, _ := ioutil.ReadFile(path); string(b) != "dddddd\neeeeee\nffffff\ngggggg\n" {
+		t.Errorf("got %q", b)
+	}
+}
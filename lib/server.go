@@ -3,11 +3,19 @@ package lib
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -34,60 +42,278 @@ var authorization = http.CanonicalHeaderKey("Authorization")
 type Server struct {
 	User            string
 	Pass            string
+	PassHash        string // Used instead of Pass if set. See HashPassword.
 	Host            string
 	AllowAnonymous  bool
 	RestrictedPorts map[int]struct{}
 
+	// Credentials, if set, is used instead of User and Pass.
+	Credentials Credentials
+	// ClientCertAuth accepts verified TLS client certificates as
+	// credentials, bypassing AuthSchemes. Verification itself is done by
+	// the tls.Config of the listener (ClientCAs and ClientAuth).
+	ClientCertAuth bool
+	// DeniedNets are networks no client may connect to, checked against
+	// resolved addresses at dial time. See DefaultDeniedNets.
+	DeniedNets  []*net.IPNet
+	DialTimeout time.Duration // Defaults to 30 seconds
+	// Policy, if set, decides which destinations each user may reach.
+	Policy *Policy
+	// Routes decide which destinations are reached through an Upstream.
+	// Destinations matching no route are connected to directly.
+	Routes []*Route
+	// Tokens verifies Bearer tokens. Bearer is disabled if nil.
+	Tokens TokenVerifier
+	// AuthSchemes lists the accepted authentication schemes
+	// (SchemeBasic, SchemeDigest, SchemeBearer).
+	// Defaults to Basic, and Bearer if Tokens is set.
+	AuthSchemes []string
+	// Admins are the users allowed on the status page and the /conns API.
+	// Defaults to User.
+	Admins []string
+	// Tracker, if set, tracks requests in flight for the status page and
+	// for draining.
+	Tracker *Tracker
+	// AccessLog, if set, logs every request and tunnel.
+	AccessLog *AccessLog
+	// Metrics, if set, counts requests and errors, and is served as
+	// /metrics to authenticated clients.
+	Metrics *Metrics
+	// TracerProvider, if set, traces requests and tunnels, continuing the
+	// traces of clients sending traceparent.
+	TracerProvider trace.TracerProvider
+	// PropagateTrace sends traceparent on forwarded requests.
+	PropagateTrace bool
+	// Digest, if set, issues and validates Digest nonces instead of the
+	// Server's own.
+	Digest *DigestAuth
+
+	digest        DigestAuth
+	transportOnce sync.Once
+	tr            http.RoundTripper
+
 	debugInfo
 }
 
-func (srv *Server) checkAuth(r *http.Request, h string) bool {
+var (
+	errNoCredentials  = errors.New("no credentials")
+	errBadCredentials = errors.New("bad credentials")
+	errStaleNonce     = errors.New("stale nonce")
+)
+
+func (srv *Server) schemeEnabled(scheme string) bool {
+	if scheme == SchemeBearer && srv.Tokens == nil {
+		return false
+	}
+	if len(srv.AuthSchemes) == 0 {
+		return scheme == SchemeBasic || scheme == SchemeBearer
+	}
+	for _, s := range srv.AuthSchemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity describes an authenticated client.
+type Identity struct {
+	User   string
+	Claims map[string]interface{} // Set for Bearer auth
+}
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+// IdentityFromContext returns the client identity of a proxied request,
+// or nil for anonymous requests.
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey).(*Identity)
+	return id
+}
+
+func withIdentity(r *http.Request, id *Identity) *http.Request {
+	if id == nil {
+		return r
+	}
+	if a := activeOf(r); a != nil {
+		a.mu.Lock()
+		a.user = id.User
+		a.mu.Unlock()
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey, id))
+}
+
+// checkAuth authenticates the credentials in header h.
+// The Identity is nil when AllowAnonymous is set.
+func (srv *Server) checkAuth(r *http.Request, h string) (*Identity, error) {
 	if srv.AllowAnonymous {
 		r.Header.Del(h)
-		return true
+		return nil, nil
+	}
+	if srv.ClientCertAuth && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if name := certIdentity(r.TLS.VerifiedChains[0][0]); name != "" {
+			r.Header.Del(h)
+			return &Identity{User: name}, nil
+		}
 	}
 	s := strings.SplitN(r.Header.Get(h), " ", 2)
 	if len(s) != 2 {
-		return false
+		return nil, errNoCredentials
 	}
 	r.Header.Del(h)
-	b, err := base64.StdEncoding.DecodeString(s[1])
+	var user string
+	var err error
+	switch {
+	case strings.EqualFold(s[0], SchemeBasic) && srv.schemeEnabled(SchemeBasic):
+		user, err = srv.checkBasic(s[1])
+	case strings.EqualFold(s[0], SchemeDigest) && srv.schemeEnabled(SchemeDigest):
+		user, err = srv.checkDigest(r, s[1])
+	case strings.EqualFold(s[0], SchemeBearer) && srv.schemeEnabled(SchemeBearer):
+		return srv.checkBearer(s[1])
+	default:
+		err = errNoCredentials
+	}
 	if err != nil {
-		return false
+		return nil, err
+	}
+	return &Identity{User: user}, nil
+}
+
+func (srv *Server) checkBearer(token string) (*Identity, error) {
+	claims, err := srv.Tokens.Verify(strings.TrimSpace(token))
+	if err != nil {
+		log.Printf("Bearer auth: %v", err)
+		return nil, errBadCredentials
+	}
+	sub, _ := claims["sub"].(string)
+	return &Identity{User: sub, Claims: claims}, nil
+}
+
+func (srv *Server) checkBasic(cred string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(cred)
+	if err != nil {
+		return "", errBadCredentials
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
-	if len(pair) != 2 {
+	if len(pair) != 2 || !srv.checkPassword(pair[0], pair[1]) {
+		return "", errBadCredentials
+	}
+	return pair[0], nil
+}
+
+// checkPassword checks user and pass against Credentials, or else against
+// User and Pass or PassHash.
+func (srv *Server) checkPassword(user, pass string) bool {
+	if srv.Credentials != nil {
+		return srv.Credentials.Check(user, pass)
+	}
+	if srv.Pass == "" && srv.PassHash == "" {
 		return false
 	}
+	userOK := constantTimeEqual(user, srv.User)
+	if srv.PassHash != "" {
+		return checkHash(srv.PassHash, pass) && userOK
+	}
+	return constantTimeEqual(pass, srv.Pass) && userOK
+}
+
+// challenge sets authentication challenges for all enabled schemes in header h.
+func (srv *Server) challenge(w http.ResponseWriter, h string, err error) {
+	if srv.schemeEnabled(SchemeDigest) {
+		for _, c := range srv.digestAuth().challenges(err == errStaleNonce) {
+			w.Header().Add(h, c)
+		}
+	}
+	if srv.schemeEnabled(SchemeBasic) {
+		w.Header().Add(h, `Basic realm="`+realm+`"`)
+	}
+	if srv.schemeEnabled(SchemeBearer) {
+		w.Header().Add(h, `Bearer realm="`+realm+`"`)
+	}
+}
 
-	return pair[0] == srv.User && pair[1] == srv.Pass
+func (srv *Server) unauthorized(w http.ResponseWriter, _ *http.Request, err error) {
+	srv.challenge(w, "WWW-Authenticate", err)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 }
 
-func proxyAuthRequired(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+func (srv *Server) proxyAuthRequired(w http.ResponseWriter, req *http.Request, err error) {
+	logReason(req, err.Error())
+	srv.Metrics.authFailed(err)
+	srv.challenge(w, "Proxy-Authenticate", err)
 	http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
 }
 
 func (s *Server) localHandler(w http.ResponseWriter, req *http.Request) {
-	s.status(w, req)
+	switch req.URL.Path {
+	case "/proxy.pac", "/wpad.dat":
+		s.servePAC(w, req)
+	case "/metrics":
+		s.serveMetrics(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// AdminHandler serves the status page, metrics and the /conns API on any
+// host, without proxying, for an admin listener.
+func (a *AtomicServer) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s := a.Load()
+		switch {
+		case req.URL.Path == "/metrics":
+			s.serveMetrics(w, req)
+		case req.URL.Path == "/conns", strings.HasPrefix(req.URL.Path, "/conns/"):
+			s.serveConns(w, req)
+		default:
+			s.status(w, req)
+		}
+	})
+}
+
+func destinationError(w http.ResponseWriter, req *http.Request, err error) {
+	logReason(req, err.Error())
+	var dnsErr *net.DNSError
+	switch {
+	case isForbidden(err):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &dnsErr):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
 }
 
 func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	req = srv.startRequest(req)
-	defer srv.endRequest(req)
+	srv.logRequest(req)
+	req = srv.record(req)
+	req, done := srv.Tracker.start(req)
+	defer done()
+	w = recordResponse(w, req)
+	defer func() { srv.recordDone(req) }()
 
 	if req.Host == srv.Host {
 		srv.localHandler(w, req)
 		return
 	}
 
-	if !srv.checkAuth(req, proxyAuthorization) {
-		proxyAuthRequired(w, req)
+	_, span := startSpan(req.Context(), "auth")
+	id, err := srv.checkAuth(req, proxyAuthorization)
+	endSpan(span, err)
+	if err != nil {
+		srv.proxyAuthRequired(w, req, err)
 		return
 	}
+	req = withIdentity(req, id)
 
 	if req.Method == "CONNECT" {
+		if req, err = srv.checkDestination(req, "", req.Host); err != nil {
+			destinationError(w, req, err)
+			return
+		}
 		srv.connectHandler(w, req)
 		return
 	}
@@ -98,6 +324,15 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
+	if req, err = srv.checkDestination(req, req.URL.Scheme, defaultPort(req.URL)); err != nil {
+		destinationError(w, req, err)
+		return
+	}
+	tr, err := srv.forwardTransport(req, defaultPort(req.URL))
+	if err != nil {
+		destinationError(w, req, err)
+		return
+	}
 	req.RequestURI = ""
 
 	// Remove hop-by-hop headers
@@ -123,21 +358,30 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 		}()
 	}
-	outreq := req.WithContext(ctx)
+	fctx, span := startSpan(ctx, "forward", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", req.URL.String())))
+	if srv.PropagateTrace {
+		propagation.TraceContext{}.Inject(fctx, propagation.HeaderCarrier(req.Header))
+	}
+	outreq := req.WithContext(fctx)
 	if req.ContentLength == 0 {
 		outreq.Body = nil
 	}
 
-	tr := http.DefaultTransport
 	srv.logOutgoingRequest(outreq)
 
 	resp, err := tr.RoundTrip(outreq)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	endSpan(span, err)
 	if err != nil {
 		log.Printf("RoundTrip: %v: %s", err, req.URL.String())
 		outreq.WithContext(context.TODO())
 		dump, _ := httputil.DumpRequestOut(outreq, false)
 		log.Printf(">> %q\n", dump)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logReason(req, err.Error())
+		http.Error(w, err.Error(), dialErrorStatus(err))
 		return
 	}
 
@@ -154,9 +398,13 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h["Public"] = nil
 
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	_, span = startSpan(req.Context(), "copy response")
+	n, err := io.Copy(w, resp.Body)
+	span.SetAttributes(attribute.Int64("proxy.bytes_down", n))
+	endSpan(span, err)
 	if err != nil {
 		log.Print(err)
+		logReason(req, err.Error())
 	}
 	resp.Body.Close()
 }
@@ -0,0 +1,501 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929), and
+// SOCKS4 and SOCKS4a on the same port.
+const (
+	socks4Version = 4
+	socks5Version = 5
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksSucceeded         = 0
+	socksGeneralFailure    = 1
+	socksNotAllowed        = 2
+	socksHostUnreachable   = 4
+	socksConnectionRefused = 5
+	socksCmdNotSupported   = 7
+	socksAtypNotSupported  = 8
+)
+
+const socksHandshakeTimeout = 30 * time.Second
+
+var errSOCKSAtyp = errors.New("unsupported address type")
+
+// ServeSOCKS serves SOCKS connections accepted on l, each with the Server
+// stored at the time, until l is closed.
+func (a *AtomicServer) ServeSOCKS(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("SOCKS: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go a.Load().serveSOCKS(c)
+	}
+}
+
+func (srv *Server) serveSOCKS(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	br := bufio.NewReader(c)
+	ver, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+	switch ver {
+	case socks4Version:
+		err = srv.serveSOCKS4(c, br)
+	case socks5Version:
+		err = srv.serveSOCKS5(c, br)
+	default:
+		err = errors.New("unsupported version " + strconv.Itoa(int(ver)))
+	}
+	if err != nil {
+		log.Printf("SOCKS %s: %v", c.RemoteAddr(), err)
+	}
+}
+
+// socksReply maps an error connecting to the destination to a reply code.
+func socksReply(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case isForbidden(err):
+		return socksNotAllowed
+	case errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	}
+	return socksGeneralFailure
+}
+
+// socksAddr encodes the address of a TCP or UDP socket.
+func socksAddr(a net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	var b []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socksAtypIPv4}, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append([]byte{socksAtypIPv6}, ip16...)
+	} else {
+		b = []byte{socksAtypIPv4, 0, 0, 0, 0}
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// readSOCKSAddr reads an address of type atyp and a port.
+func readSOCKSAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errSOCKSAtyp
+	}
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// readString reads a string prefixed by its length byte.
+func readString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+// socksRequest returns a request standing for a SOCKS command, so that it's
+// checked, tracked and logged like a proxied HTTP request.
+func socksRequest(c net.Conn, method, hostport string, id *Identity) *http.Request {
+	req := &http.Request{
+		Method:     method,
+		Host:       hostport,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	return withIdentity(req.WithContext(context.Background()), id)
+}
+
+// startSOCKS starts tracking and logging a SOCKS command until the returned
+// function is called.
+func (srv *Server) startSOCKS(c net.Conn, proto, method, hostport string, id *Identity) (*http.Request, func()) {
+	req := socksRequest(c, method, hostport, id)
+	req.Proto = proto
+	req = srv.record(req)
+	req, done := srv.Tracker.start(req)
+	return req, func() {
+		srv.recordDone(req)
+		done()
+	}
+}
+
+func (srv *Server) serveSOCKS5(c net.Conn, br *bufio.Reader) error {
+	methods, err := readString(br)
+	if err != nil {
+		return err
+	}
+	method := byte(socksAuthNoAcceptable)
+	for _, m := range []byte(methods) {
+		if m == socksAuthNone && srv.AllowAnonymous {
+			method = m
+			break
+		}
+		if m == socksAuthPassword {
+			method = m
+		}
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	var id *Identity
+	switch method {
+	case socksAuthNoAcceptable:
+		return errors.New("no acceptable authentication method")
+	case socksAuthPassword:
+		if id, err = srv.socks5Password(c, br); err != nil {
+			return err
+		}
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version {
+		return errors.New("bad request version")
+	}
+	hostport, err := readSOCKSAddr(br, hdr[3])
+	if err == errSOCKSAtyp {
+		socks5Reply(c, socksAtypNotSupported, nil)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	switch hdr[1] {
+	case socksCmdConnect:
+		req, done := srv.startSOCKS(c, "SOCKS5", "CONNECT", hostport, id)
+		defer done()
+		return srv.socksConnect(req, c, br, func(err error, bound net.Addr) error {
+			if err != nil {
+				return socks5Reply(c, socksReply(err), nil)
+			}
+			return socks5Reply(c, socksSucceeded, bound)
+		})
+	case socksCmdUDPAssociate:
+		req, done := srv.startSOCKS(c, "SOCKS5", "UDP", hostport, id)
+		defer done()
+		return srv.socks5UDP(req, c, br)
+	}
+	socks5Reply(c, socksCmdNotSupported, nil)
+	return errors.New("unsupported command " + strconv.Itoa(int(hdr[1])))
+}
+
+// socks5Password authenticates a client as in RFC 1929.
+func (srv *Server) socks5Password(c net.Conn, br *bufio.Reader) (*Identity, error) {
+	ver, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if ver != 1 {
+		return nil, errors.New("bad authentication version")
+	}
+	user, err := readString(br)
+	if err != nil {
+		return nil, err
+	}
+	pass, err := readString(br)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.AllowAnonymous && !srv.checkPassword(user, pass) {
+		srv.Metrics.authFailed(errBadCredentials)
+		c.Write([]byte{1, 1})
+		return nil, errBadCredentials
+	}
+	if _, err := c.Write([]byte{1, 0}); err != nil {
+		return nil, err
+	}
+	if srv.AllowAnonymous {
+		return nil, nil
+	}
+	return &Identity{User: user}, nil
+}
+
+func socks5Reply(c net.Conn, rep byte, bound net.Addr) error {
+	_, err := c.Write(append([]byte{socks5Version, rep, 0}, socksAddr(bound)...))
+	return err
+}
+
+// socksConnect connects to req.Host and copies between it and c. reply
+// sends the client the result of connecting.
+func (srv *Server) socksConnect(req *http.Request, c net.Conn, br *bufio.Reader, reply func(error, net.Addr) error) error {
+	fail := func(err error) error {
+		logStatus(req, dialErrorStatus(err))
+		logReason(req, err.Error())
+		reply(err, nil)
+		return err
+	}
+	req, err := srv.checkDestination(req, "", req.Host)
+	if err != nil {
+		return fail(err)
+	}
+	remote, err := srv.dialDestination(req, req.Host)
+	if err != nil {
+		return fail(err)
+	}
+	defer remote.Close()
+	logStatus(req, http.StatusOK)
+	defer srv.Metrics.tunnel("SOCKS")()
+	if err := reply(nil, remote.LocalAddr()); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	log.Printf("SOCKS connected: %s", req.Host)
+	onClose(req, func() {
+		c.Close()
+		remote.Close()
+	})
+	hijackedHandler(req, remote, c, bufio.NewReadWriter(br, bufio.NewWriter(c)))
+	return nil
+}
+
+// socks5UDP relays datagrams between the client and destinations until the
+// control connection c is closed. Only datagrams from the client's address,
+// and replies from destinations it has sent to, are relayed.
+func (srv *Server) socks5UDP(req *http.Request, c net.Conn, br *bufio.Reader) error {
+	local, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		socks5Reply(c, socksCmdNotSupported, nil)
+		return errors.New("UDP ASSOCIATE needs a TCP listener")
+	}
+	clientIP := c.RemoteAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		socks5Reply(c, socksGeneralFailure, nil)
+		return err
+	}
+	defer relay.Close()
+	out, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		socks5Reply(c, socksGeneralFailure, nil)
+		return err
+	}
+	defer out.Close()
+	logStatus(req, http.StatusOK)
+	if err := socks5Reply(c, socksSucceeded, relay.LocalAddr()); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	log.Printf("SOCKS5 UDP associated: %s", relay.LocalAddr())
+	closeAll := func() {
+		c.Close()
+		relay.Close()
+		out.Close()
+	}
+	onClose(req, closeAll)
+	go func() {
+		io.Copy(ioutil.Discard, br)
+		closeAll()
+	}()
+
+	var mu sync.Mutex
+	var client *net.UDPAddr
+	sent := make(map[string]bool)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := out.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			ok, to := sent[from.String()], client
+			mu.Unlock()
+			if ok {
+				hdr := append([]byte{0, 0, 0}, socksAddr(from)...)
+				relay.WriteToUDP(append(hdr, buf[:n]...), to)
+				logBytes(req, 0, int64(n))
+			}
+		}
+	}()
+
+	type dest struct {
+		addr *net.UDPAddr
+		err  error
+	}
+	dests := make(map[string]dest)
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		if !from.IP.Equal(clientIP) {
+			continue
+		}
+		r := bytes.NewReader(buf[:n])
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[2] != 0 {
+			// Fragments aren't supported.
+			continue
+		}
+		hostport, err := readSOCKSAddr(r, hdr[3])
+		if err != nil {
+			continue
+		}
+		d, ok := dests[hostport]
+		if !ok {
+			var dreq *http.Request
+			if dreq, d.err = srv.checkDestination(req, "", hostport); d.err == nil {
+				d.addr, d.err = net.ResolveUDPAddr("udp", hostport)
+			}
+			if d.err == nil {
+				d.err = srv.checkAddress("udp", d.addr.String(), nil)
+			}
+			if d.err == nil {
+				d.err = srv.checkDialed(dreq.Context(), d.addr.String())
+			}
+			if d.err != nil {
+				log.Printf("SOCKS5 UDP %s: %v", hostport, d.err)
+			}
+			dests[hostport] = d
+		}
+		if d.err != nil {
+			continue
+		}
+		mu.Lock()
+		client = from
+		sent[d.addr.String()] = true
+		mu.Unlock()
+		out.WriteToUDP(buf[n-r.Len():n], d.addr)
+		logBytes(req, int64(r.Len()), 0)
+	}
+}
+
+// SOCKS4 and SOCKS4a have no password, so unless AllowAnonymous is set,
+// the user ID must be "user:password".
+const (
+	socks4Granted  = 90
+	socks4Rejected = 91
+)
+
+func readNulString(br *bufio.Reader) (string, error) {
+	b, err := br.ReadSlice(0)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+func socks4Reply(c net.Conn, granted bool) error {
+	rep := byte(socks4Rejected)
+	if granted {
+		rep = socks4Granted
+	}
+	_, err := c.Write([]byte{0, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (srv *Server) serveSOCKS4(c net.Conn, br *bufio.Reader) error {
+	var hdr [7]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return err
+	}
+	userID, err := readNulString(br)
+	if err != nil {
+		return err
+	}
+	reply := func(err error, _ net.Addr) error {
+		return socks4Reply(c, err == nil)
+	}
+	if hdr[0] != socksCmdConnect {
+		socks4Reply(c, false)
+		return errors.New("unsupported command " + strconv.Itoa(int(hdr[0])))
+	}
+
+	host := net.IP(hdr[3:7]).String()
+	// SOCKS4a sends the name after the user ID, with an address of 0.0.0.x.
+	if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+		if host, err = readNulString(br); err != nil {
+			return err
+		}
+	}
+	hostport := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(hdr[1:3]))))
+
+	var id *Identity
+	if !srv.AllowAnonymous {
+		p := strings.SplitN(userID, ":", 2)
+		if len(p) != 2 || !srv.checkPassword(p[0], p[1]) {
+			srv.Metrics.authFailed(errBadCredentials)
+			socks4Reply(c, false)
+			return errBadCredentials
+		}
+		id = &Identity{User: p[0]}
+	}
+	req, done := srv.startSOCKS(c, "SOCKS4", "CONNECT", hostport, id)
+	defer done()
+	return srv.socksConnect(req, c, br, reply)
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func serveSOCKS(t *testing.T, s *Server) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewAtomicServer(s).ServeSOCKS(l)
+	return l
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	echo := createEchoServer()
+	defer echo.Close()
+	_, p, _ := net.SplitHostPort(echo.Addr().String())
+	l := serveSOCKS(t, &Server{User: "user", Pass: "pass", RestrictedPorts: map[int]struct{}{25: {}}})
+	defer l.Close()
+
+	d, _ := proxy.SOCKS5("tcp", l.Addr().String(), &proxy.Auth{User: "user", Password: "pass"}, proxy.Direct)
+	c, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ping" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	c.Close()
+
+	for _, tc := range []struct {
+		user, pass, addr, want string
+	}{
+		{"user", "wrong", echo.Addr().String(), "authentication failed"},
+		{"user", "pass", "127.0.0.1:25", "not allowed"},
+	} {
+		d, _ := proxy.SOCKS5("tcp", l.Addr().String(), &proxy.Auth{User: tc.user, Password: tc.pass}, proxy.Direct)
+		if _, err := d.Dial("tcp", tc.addr); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s:%s %s: got %v want %q", tc.user, tc.pass, tc.addr, err, tc.want)
+		}
+	}
+
+	// Policy applies as to CONNECT; it denies everything without rules
+	s := &Server{AllowAnonymous: true, Policy: NewPolicy(nil)}
+	l2 := serveSOCKS(t, s)
+	defer l2.Close()
+	d, _ = proxy.SOCKS5("tcp", l2.Addr().String(), nil, proxy.Direct)
+	if _, err := d.Dial("tcp", "localhost:"+p); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("denied by policy: got %v", err)
+	}
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(b[:n], from)
+		}
+	}()
+	l := serveSOCKS(t, &Server{AllowAnonymous: true})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte{5, 1, socksAuthNone})
+	c.Write([]byte{5, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(c, b); err != nil || !bytes.Equal(b[:4], []byte{5, socksAuthNone, 5, socksSucceeded}) {
+		t.Fatalf("UDP ASSOCIATE: got %v, %v", b, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(b[6:10]), Port: int(b[10])<<8 | int(b[11])}
+
+	u, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	hdr := append([]byte{0, 0, 0}, socksAddr(echo.LocalAddr())...)
+	u.Write(append(hdr, "ping"...))
+	b = make([]byte, 1500)
+	n, err := u.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b[:n]; !bytes.Equal(got, append(hdr, "ping"...)) {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSOCKS4(t *testing.T) {
+	echo := createEchoServer()
+	defer echo.Close()
+	addr := echo.Addr().(*net.TCPAddr)
+	l := serveSOCKS(t, &Server{User: "user", Pass: "pass"})
+	defer l.Close()
+
+	port := []byte{byte(addr.Port >> 8), byte(addr.Port)}
+	for _, tc := range []struct {
+		name string
+		req  []byte
+		want byte
+	}{
+		{"SOCKS4", append(append([]byte{4, socksCmdConnect}, port...), append(addr.IP.To4(), "user:pass\x00"...)...), socks4Granted},
+		{"SOCKS4a", append(append([]byte{4, socksCmdConnect}, port...), "\x00\x00\x00\x01user:pass\x00localhost\x00"...), socks4Granted},
+		{"bad user ID", append(append([]byte{4, socksCmdConnect}, port...), append(addr.IP.To4(), "user\x00"...)...), socks4Rejected},
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write(tc.req)
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(c, b); err != nil || b[1] != tc.want {
+			t.Errorf("%s: got %v, %v want %d", tc.name, b, err, tc.want)
+		}
+		if tc.want == socks4Granted {
+			io.WriteString(c, "ping")
+			if _, err := io.ReadFull(c, b[:4]); err != nil || string(b[:4]) != "ping" {
+				t.Errorf("%s: got %q, %v", tc.name, b[:4], err)
+			}
+		}
+		c.Close()
+	}
+}
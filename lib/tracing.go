@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/tsawada/javertd/lib"
+
+// startSpan starts a span as a child of the one in ctx, with the same
+// TracerProvider. Without a span in ctx, as when tracing is off, it's a
+// no-op.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan ends span, marking it failed with err if set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startTrace starts the span of req, continuing the trace of the client if
+// it sent a traceparent header.
+func (srv *Server) startTrace(req *http.Request) *http.Request {
+	if srv.TracerProvider == nil {
+		return req
+	}
+	ctx := propagation.TraceContext{}.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	client, _, _ := net.SplitHostPort(req.RemoteAddr)
+	ctx, _ = srv.TracerProvider.Tracer(tracerName).Start(ctx, req.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("network.protocol.name", req.Proto),
+			attribute.String("client.address", client),
+			attribute.String("proxy.target", target(req)),
+		))
+	return req.WithContext(ctx)
+}
+
+// endTrace ends the span of req with what was recorded.
+func endTrace(req *http.Request, status int, up, down int64, reason string) {
+	span := trace.SpanFromContext(req.Context())
+	if !span.IsRecording() {
+		return
+	}
+	if id := IdentityFromContext(req.Context()); id != nil {
+		span.SetAttributes(attribute.String("user.name", id.User))
+	}
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", status),
+		attribute.Int64("proxy.bytes_up", up),
+		attribute.Int64("proxy.bytes_down", down),
+	)
+	if status >= 500 {
+		span.SetStatus(codes.Error, reason)
+	}
+	span.End()
+}
+
+// traceDNS adds a span for name resolution while dialing with ctx.
+func traceDNS(ctx context.Context) context.Context {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ctx
+	}
+	var span trace.Span
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			_, span = startSpan(ctx, "resolve", trace.WithAttributes(attribute.String("server.address", info.Host)))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if span != nil {
+				span.SetAttributes(attribute.Int("proxy.addresses", len(info.Addrs)))
+				endSpan(span, info.Err)
+			}
+		},
+	})
+}
+
+// traceDial starts the span of dialing address.
+func traceDial(ctx context.Context, name, address string) (context.Context, trace.Span) {
+	ctx, span := startSpan(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		n, _ := strconv.Atoi(port)
+		span.SetAttributes(attribute.String("server.address", host), attribute.Int("server.port", n))
+	}
+	return traceDNS(ctx), span
+}
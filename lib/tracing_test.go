@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// endedSpans returns the spans ended by name, once root is. Root spans end
+// after the response has been sent.
+func endedSpans(sr *tracetest.SpanRecorder, root string) map[string]sdktrace.ReadOnlySpan {
+	m := make(map[string]sdktrace.ReadOnlySpan)
+	for deadline := time.Now().Add(time.Second); m[root] == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, s := range sr.Ended() {
+			m[s.Name()] = s
+		}
+	}
+	return m
+}
+
+func TestTracing(t *testing.T) {
+	var traceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("Traceparent")
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+	// Through localhost, so that dialing resolves a name
+	origin := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	proxy := httptest.NewServer(&Server{Host: "proxy", User: "user", Pass: "pass", TracerProvider: tp, PropagateTrace: true})
+	defer proxy.Close()
+
+	// The client's trace is continued.
+	const clientTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("GET", origin, nil)
+	req.Header.Set("Traceparent", "00-"+clientTrace+"-00f067aa0ba902b7-01")
+	resp, err := getProxiedClient(proxy).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	spans := endedSpans(sr, "GET")
+	for _, name := range []string{"GET", "auth", "dial", "resolve", "forward", "copy response"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span in %v", name, spans)
+			continue
+		}
+		if id := s.SpanContext().TraceID().String(); id != clientTrace {
+			t.Errorf("%s: got trace %s want %s", name, id, clientTrace)
+		}
+	}
+	if s := spans["dial"]; s != nil && s.Parent().SpanID() != spans["forward"].SpanContext().SpanID() {
+		t.Errorf("dial isn't a child of forward")
+	}
+	if f := spans["forward"]; f != nil {
+		want := fmt.Sprintf("00-%s-%s-01", clientTrace, f.SpanContext().SpanID())
+		if traceparent != want {
+			t.Errorf("origin got traceparent %q want %q", traceparent, want)
+		}
+	}
+
+	// Tunnels
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(ts.URL, "http://")
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", host, host)
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+	conn.Close()
+	spans = endedSpans(sr, "CONNECT")
+	c, tunnel := spans["CONNECT"], spans["tunnel"]
+	if c == nil || tunnel == nil {
+		t.Fatalf("no CONNECT and tunnel spans in %v", spans)
+	}
+	if tunnel.Parent().SpanID() != c.SpanContext().SpanID() {
+		t.Errorf("tunnel isn't a child of CONNECT")
+	}
+}
@@ -0,0 +1,397 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/proxy"
+)
+
+// Upstream is a parent proxy: http://, https:// or socks5://, with
+// credentials in the URL if it requires them. Upstreams are shared by the
+// Servers routing through them, and remember whether they're failing.
+type Upstream struct {
+	URL         *url.URL
+	RootCAs     *x509.CertPool // Verifies https upstreams; nil for the system roots
+	Weight      int            // Share of connections within a Pool; defaults to 1
+	DialTimeout time.Duration  // Defaults to 30 seconds
+	Metrics     *Metrics       // Records dial latency if set
+
+	mu        sync.Mutex
+	downUntil time.Time
+
+	transportOnce sync.Once
+	tr            http.RoundTripper
+}
+
+// upstreamRetry is how long an upstream that failed a connection is
+// avoided when no health check says otherwise.
+const upstreamRetry = 30 * time.Second
+
+// ParseUpstream parses the URL of a parent proxy.
+func ParseUpstream(s string) (*Upstream, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream %q has no host", u.Redacted())
+	}
+	return &Upstream{URL: u, Weight: 1}, nil
+}
+
+func (u *Upstream) String() string {
+	return u.URL.Redacted()
+}
+
+// Healthy reports whether u is believed to be working.
+func (u *Upstream) Healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().After(u.downUntil)
+}
+
+// setDown marks u as failing until t, or as working if t is zero, and logs
+// changes.
+func (u *Upstream) setDown(t time.Time, err error) {
+	u.mu.Lock()
+	now := time.Now()
+	wasUp := now.After(u.downUntil)
+	u.downUntil = t
+	isUp := now.After(t)
+	u.mu.Unlock()
+	switch {
+	case wasUp && !isUp:
+		log.Printf("Upstream %v is down: %v", u, err)
+	case !wasUp && isUp:
+		log.Printf("Upstream %v is up", u)
+	}
+}
+
+// addr returns host:port of the upstream.
+func (u *Upstream) addr() string {
+	if u.URL.Port() != "" {
+		return u.URL.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[u.URL.Scheme]
+	return net.JoinHostPort(u.URL.Hostname(), port)
+}
+
+// upstreamError is returned when an upstream can't be used (err) or
+// refuses a tunnel (refused). Only the former is worth trying another
+// upstream for.
+type upstreamError struct {
+	u       *Upstream
+	err     error
+	refused bool
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream %v: %v", e.u, e.err)
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// isUpstreamDown reports whether err is a failure to reach an upstream.
+func isUpstreamDown(err error) bool {
+	var ue *upstreamError
+	return errors.As(err, &ue) && !ue.refused
+}
+
+// dial connects to u. Unlike Server.dial, it doesn't refuse DeniedNets,
+// where parent proxies commonly are.
+func (u *Upstream) dial(ctx context.Context) (net.Conn, error) {
+	timeout := u.DialTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	dctx, span := traceDial(ctx, "dial upstream", u.addr())
+	span.SetAttributes(attribute.String("proxy.upstream", u.String()))
+	start := time.Now()
+	c, err := d.DialContext(dctx, "tcp", u.addr())
+	u.Metrics.dialed(u.String(), start, err)
+	endSpan(span, err)
+	if err != nil {
+		return nil, &upstreamError{u: u, err: err}
+	}
+	if u.URL.Scheme != "https" {
+		return c, nil
+	}
+	_, span = startSpan(ctx, "upstream tls", trace.WithAttributes(attribute.String("proxy.upstream", u.String())))
+	tc := tls.Client(c, &tls.Config{ServerName: u.URL.Hostname(), RootCAs: u.RootCAs})
+	err = tc.HandshakeContext(ctx)
+	endSpan(span, err)
+	if err != nil {
+		c.Close()
+		return nil, &upstreamError{u: u, err: err}
+	}
+	return tc, nil
+}
+
+// bufferedConn is a net.Conn whose reads start with what r has buffered.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// dialTunnel opens a tunnel to hostport through u.
+func (u *Upstream) dialTunnel(ctx context.Context, hostport string) (net.Conn, error) {
+	if u.URL.Scheme == "socks5" {
+		var auth *proxy.Auth
+		if u.URL.User != nil {
+			pass, _ := u.URL.User.Password()
+			auth = &proxy.Auth{User: u.URL.User.Username(), Password: pass}
+		}
+		d, err := proxy.SOCKS5("tcp", u.addr(), auth, upstreamDialer{u})
+		if err != nil {
+			return nil, err
+		}
+		c, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", hostport)
+		if err != nil && !isUpstreamDown(err) {
+			err = &upstreamError{u: u, err: err, refused: true}
+		}
+		return c, err
+	}
+
+	c, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: hostport},
+		Host:   hostport,
+		Header: make(http.Header),
+	}
+	if u.URL.User != nil {
+		pass, _ := u.URL.User.Password()
+		req.Header.Set(proxyAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte(u.URL.User.Username()+":"+pass)))
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, &upstreamError{u: u, err: err}
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, &upstreamError{u: u, err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, &upstreamError{u: u, err: errors.New(resp.Status), refused: true}
+	}
+	return &bufferedConn{c, br}, nil
+}
+
+// upstreamDialer connects the SOCKS5 client to its upstream.
+type upstreamDialer struct {
+	u *Upstream
+}
+
+func (d upstreamDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.u.dial(context.Background())
+}
+
+func (d upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d.u.dial(ctx)
+}
+
+// transport returns the RoundTripper forwarding requests through u.
+func (u *Upstream) transport() http.RoundTripper {
+	u.transportOnce.Do(func() {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.Proxy = http.ProxyURL(u.URL)
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return u.dial(ctx)
+		}
+		if u.URL.Scheme == "https" {
+			t.DialTLSContext = t.DialContext
+		}
+		u.tr = t
+	})
+	return u.tr
+}
+
+// check probes u by connecting to it or, if probeURL is set, by getting
+// probeURL through it.
+func (u *Upstream) check(ctx context.Context, probeURL string) error {
+	if probeURL == "" {
+		c, err := u.dial(ctx)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", probeURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.transport().RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// HealthCheck probes u every interval until ctx is done. See check for
+// probeURL. A failing upstream is avoided until it passes again.
+func (u *Upstream) HealthCheck(ctx context.Context, interval time.Duration, probeURL string) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		cctx, cancel := context.WithTimeout(ctx, interval)
+		err := u.check(cctx, probeURL)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			u.setDown(time.Now().Add(100*365*24*time.Hour), err)
+		} else {
+			u.setDown(time.Time{}, nil)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Route sends destinations matching its conditions, which are those of a
+// policy Rule, through Pool, or directly if Pool is nil:
+//
+//	direct|NAME [user=GLOB,...] [host=GLOB,...] [cidr=CIDR,...] ...
+type Route struct {
+	Pool *Pool
+	rule Rule
+}
+
+func (r *Route) String() string {
+	return r.rule.String()
+}
+
+// ParseRoute parses a single route. NAME must be in pools. n is the line
+// number used in errors.
+func ParseRoute(line string, n int, pools map[string]*Pool) (*Route, error) {
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return nil, fmt.Errorf("line %d: empty route", n)
+	}
+	r := &Route{rule: Rule{Allow: true, Line: n, text: line}}
+	if f[0] != "direct" {
+		if r.Pool = pools[f[0]]; r.Pool == nil {
+			return nil, fmt.Errorf("line %d: unknown upstream %q", n, f[0])
+		}
+	}
+	if err := r.rule.parseConditions(f[1:]); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// route returns the pool for req going to hostport, or nil to connect
+// directly. The first matching route decides.
+func (srv *Server) route(req *http.Request, scheme, hostport string) (*Pool, error) {
+	if len(srv.Routes) == 0 {
+		return nil, nil
+	}
+	needIPs := false
+	for _, r := range srv.Routes {
+		needIPs = needIPs || len(r.rule.Nets) > 0
+	}
+	d, err := destination(req, scheme, hostport, needIPs)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		// cidr routes don't match; an upstream may still know the name.
+		srv.Metrics.resolveFailed(err)
+	} else if err != nil {
+		return nil, err
+	}
+	for _, r := range srv.Routes {
+		if r.rule.match(d) {
+			return r.Pool, nil
+		}
+	}
+	return nil, nil
+}
+
+// routeUpstream is route, but also refuses DeniedNets for routed
+// destinations. Only address literals can be checked; names are resolved
+// by the upstream.
+func (srv *Server) routeUpstream(req *http.Request, scheme, hostport string) (*Pool, error) {
+	p, err := srv.route(req, scheme, hostport)
+	if err != nil || p == nil {
+		return p, err
+	}
+	if host, _, _ := net.SplitHostPort(hostport); parseIP(host) != nil {
+		if err := srv.checkAddress("tcp", hostport, nil); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Routing %s via %v", hostport, p)
+	return p, nil
+}
+
+// dialDestination connects to hostport for req, through an upstream if
+// routed so.
+func (srv *Server) dialDestination(req *http.Request, hostport string) (net.Conn, error) {
+	p, err := srv.routeUpstream(req, "", hostport)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return srv.dial(req.Context(), "tcp", hostport)
+	}
+	return p.dialTunnel(req.Context(), hostport)
+}
+
+// forwardTransport returns the RoundTripper for req going to hostport.
+func (srv *Server) forwardTransport(req *http.Request, hostport string) (http.RoundTripper, error) {
+	p, err := srv.routeUpstream(req, req.URL.Scheme, hostport)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return srv.transport(), nil
+	}
+	return p, nil
+}
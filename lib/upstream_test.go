@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpstream(t *testing.T) {
+	nets, err := ParseNets(DefaultDeniedNets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+	echo := createEchoServer()
+	defer echo.Close()
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	parent := httptest.NewServer(&Server{Host: "parent", User: "puser", Pass: "ppass"})
+	defer parent.Close()
+	socksParent := serveSOCKS(t, &Server{User: "suser", Pass: "spass"})
+	defer socksParent.Close()
+
+	for _, raw := range []string{
+		strings.Replace(parent.URL, "http://", "http://puser:ppass@", 1),
+		"socks5://suser:spass@" + socksParent.Addr().String(),
+	} {
+		u, err := ParseUpstream(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Loopback is denied, so only requests sent through the
+		// upstream succeed.
+		route, err := ParseRoute("up host=localhost", 1, map[string]*Pool{"up": {Name: "up", Upstreams: []*Upstream{u}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := httptest.NewServer(&Server{Host: "proxy", User: "user", Pass: "pass", DeniedNets: nets, Routes: []*Route{route}})
+		defer proxy.Close()
+		c := getProxiedClient(proxy)
+
+		for _, tc := range []struct {
+			url  string
+			want int
+		}{
+			{strings.Replace(ts.URL, "127.0.0.1", "localhost", 1), http.StatusOK},
+			{ts.URL, http.StatusForbidden},
+		} {
+			resp, err := c.Get(tc.url)
+			if err != nil {
+				t.Fatalf("%s: %v", u, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.want {
+				t.Errorf("%v: %s: got %d want %d", u, tc.url, resp.StatusCode, tc.want)
+			}
+		}
+
+		conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT localhost:%s HTTP/1.1\r\nHost: localhost:%s\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", echoPort, echoPort)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: CONNECT: got %v, %v", u, resp, err)
+		}
+		io.WriteString(conn, "ping")
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(br, b); err != nil || string(b) != "ping" {
+			t.Errorf("%v: CONNECT: got %q, %v", u, b, err)
+		}
+		conn.Close()
+	}
+
+	// A tunnel refused by the upstream is a bad gateway
+	u, _ := ParseUpstream(parent.URL)
+	if _, err := u.dialTunnel(context.Background(), echo.Addr().String()); dialErrorStatus(err) != http.StatusBadGateway || isUpstreamDown(err) {
+		t.Errorf("without credentials: got %v", err)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	up := map[string]*Pool{"corp": {}}
+	for _, tc := range []struct {
+		line, want string
+	}{
+		{"other", "unknown upstream"},
+		{"corp port=x", "bad port"},
+	} {
+		if _, err := ParseRoute(tc.line, 3, up); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %v want %q", tc.line, err, tc.want)
+		}
+	}
+	for _, s := range []string{"ftp://proxy", "http://"} {
+		if _, err := ParseUpstream(s); err == nil {
+			t.Errorf("%q: got no error", s)
+		}
+	}
+}
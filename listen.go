@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Listener addresses are host:port for TCP, unix:PATH for a Unix domain
+// socket, or systemd:NAME for a socket passed by systemd socket activation,
+// where NAME is the FileDescriptorName= of the socket unit or the index of
+// the socket.
+const (
+	unixPrefix    = "unix:"
+	systemdPrefix = "systemd:"
+)
+
+// listen opens the socket for addr.
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		path := strings.TrimPrefix(addr, unixPrefix)
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	case strings.HasPrefix(addr, systemdPrefix):
+		return systemdListener(strings.TrimPrefix(addr, systemdPrefix))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// removeStaleSocket removes the socket at path if it was left behind by an
+// unclean exit, which is when nothing accepts connections on it anymore.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: exists and isn't a socket", path)
+	}
+	c, err := net.Dial("unix", path)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("%s: address already in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%s: address already in use (%v)", path, err)
+	}
+	return os.Remove(path)
+}
+
+var (
+	systemdOnce  sync.Once
+	systemdFiles []*os.File
+)
+
+// listenFiles returns the sockets passed by systemd as described in
+// sd_listen_fds(3).
+func listenFiles() []*os.File {
+	systemdOnce.Do(func() {
+		if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			name := "unknown"
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			// Passed descriptors start at 3.
+			systemdFiles = append(systemdFiles, os.NewFile(uintptr(3+i), name))
+		}
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	return systemdFiles
+}
+
+func systemdListener(name string) (net.Listener, error) {
+	files := listenFiles()
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s%s: not started by systemd socket activation", systemdPrefix, name)
+	}
+	for i, f := range files {
+		if f.Name() == name || strconv.Itoa(i) == name {
+			return net.FileListener(f)
+		}
+	}
+	return nil, fmt.Errorf("%s%s: no such socket passed by systemd", systemdPrefix, name)
+}
+
+// checkAddr reports whether addr is a well-formed listener address.
+func checkAddr(addr string) error {
+	switch {
+	case strings.HasPrefix(addr, unixPrefix):
+		if addr == unixPrefix {
+			return fmt.Errorf("%q has no path", addr)
+		}
+		return nil
+	case strings.HasPrefix(addr, systemdPrefix):
+		if addr == systemdPrefix {
+			return fmt.Errorf("%q has no name", addr)
+		}
+		return nil
+	}
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", p); err != nil {
+		return err
+	}
+	return nil
+}
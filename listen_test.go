@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "javertd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	// A socket left behind is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// A live one isn't
+	if _, err := listen("unix:" + path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("socket in use: got %v", err)
+	}
+	// Nor is a file that isn't a socket
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	if _, err := listen("unix:" + file); err == nil {
+		t.Errorf("regular file: got no error")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+
+	if _, err := listen("systemd:proxy"); err == nil {
+		t.Errorf("systemd listener without socket activation: got no error")
+	}
+}